@@ -24,6 +24,9 @@ type Vendor struct {
 
 	// The name of the environment variable that contains the user using turbo
 	UsernameEnvVar string
+
+	// The name of the environment variable that contains a link to the current job
+	JobURLEnvVar string
 }
 
 // Vendors is a list of common CI/CD vendors (from https://github.com/watson/ci-info/blob/master/vendors.json)
@@ -69,14 +72,16 @@ var Vendors = []Vendor{
 		Env:      vendorEnvs{Any: []string{"BUDDY_WORKSPACE_ID"}},
 	},
 	{
-		Name:     "Buildkite",
-		Constant: "BUILDKITE",
-		Env:      vendorEnvs{Any: []string{"BUILDKITE"}},
+		Name:         "Buildkite",
+		Constant:     "BUILDKITE",
+		Env:          vendorEnvs{Any: []string{"BUILDKITE"}},
+		JobURLEnvVar: "BUILDKITE_BUILD_URL",
 	},
 	{
-		Name:     "CircleCI",
-		Constant: "CIRCLE",
-		Env:      vendorEnvs{Any: []string{"CIRCLECI"}},
+		Name:         "CircleCI",
+		Constant:     "CIRCLE",
+		Env:          vendorEnvs{Any: []string{"CIRCLECI"}},
+		JobURLEnvVar: "CIRCLE_BUILD_URL",
 	},
 	{
 		Name:     "Cirrus CI",
@@ -125,9 +130,10 @@ var Vendors = []Vendor{
 		UsernameEnvVar: "GITHUB_ACTOR",
 	},
 	{
-		Name:     "GitLab CI",
-		Constant: "GITLAB",
-		Env:      vendorEnvs{Any: []string{"GITLAB_CI"}},
+		Name:         "GitLab CI",
+		Constant:     "GITLAB",
+		Env:          vendorEnvs{Any: []string{"GITLAB_CI"}},
+		JobURLEnvVar: "CI_JOB_URL",
 	},
 	{
 		Name:     "GoCD",
@@ -155,9 +161,10 @@ var Vendors = []Vendor{
 		Env:      vendorEnvs{Any: []string{"HUDSON"}},
 	},
 	{
-		Name:     "Jenkins",
-		Constant: "JENKINS",
-		Env:      vendorEnvs{All: []string{"JENKINS_URL", "BUILD_ID"}},
+		Name:         "Jenkins",
+		Constant:     "JENKINS",
+		Env:          vendorEnvs{All: []string{"JENKINS_URL", "BUILD_ID"}},
+		JobURLEnvVar: "BUILD_URL",
 	},
 	{
 		Name:     "Magnum CI",
@@ -232,9 +239,10 @@ var Vendors = []Vendor{
 		Env:      vendorEnvs{Any: []string{"TEAMCITY_VERSION"}},
 	},
 	{
-		Name:     "Travis CI",
-		Constant: "TRAVIS",
-		Env:      vendorEnvs{Any: []string{"TRAVIS"}},
+		Name:         "Travis CI",
+		Constant:     "TRAVIS",
+		Env:          vendorEnvs{Any: []string{"TRAVIS"}},
+		JobURLEnvVar: "TRAVIS_JOB_WEB_URL",
 	},
 	// https://vercel.com/docs/concepts/projects/environment-variables/system-environment-variables
 	{
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -13,7 +14,7 @@ func (c *APIClient) RecordAnalyticsEvents(events []map[string]interface{}) error
 	}
 
 	// We don't care about the response here
-	if _, err := c.JSONPost("/v8/artifacts/events", body); err != nil {
+	if _, err := c.JSONPost(context.Background(), "/v8/artifacts/events", body); err != nil {
 		return err
 	}
 
@@ -39,6 +39,20 @@ type APIClient struct {
 // ErrTooManyFailures is returned from remote cache API methods after `maxRemoteFailCount` errors have occurred
 var ErrTooManyFailures = errors.New("skipping HTTP Request, too many failures have occurred")
 
+// StatusError is returned from the JSON request helpers when the API responds
+// with an unexpected status code. The message is the raw response body.
+type StatusError struct {
+	StatusCode int
+	Body       string
+	// Header holds the response headers, e.g. Retry-After
+	Header http.Header
+}
+
+// Error returns the response body
+func (e *StatusError) Error() string {
+	return e.Body
+}
+
 // _maxRemoteFailCount is the number of failed requests before we stop trying to upload/download
 // artifacts to the remote cache
 const _maxRemoteFailCount = uint64(3)
@@ -72,6 +86,50 @@ func NewClient(config turbostate.APIClientConfig, logger hclog.Logger, turboVers
 	return client
 }
 
+// WithTransport returns a copy of the client that sends its requests with transport,
+// e.g. to send some requests through a different proxy than the rest
+func (c *APIClient) WithTransport(transport http.RoundTripper) *APIClient {
+	client := &APIClient{
+		baseURL:      c.baseURL,
+		turboVersion: c.turboVersion,
+		HTTPClient: &retryablehttp.Client{
+			HTTPClient: &http.Client{
+				Timeout:   c.HTTPClient.HTTPClient.Timeout,
+				Transport: transport,
+			},
+			RetryWaitMin: c.HTTPClient.RetryWaitMin,
+			RetryWaitMax: c.HTTPClient.RetryWaitMax,
+			RetryMax:     c.HTTPClient.RetryMax,
+			Backoff:      c.HTTPClient.Backoff,
+			Logger:       c.HTTPClient.Logger,
+		},
+		token:        c.token,
+		teamID:       c.teamID,
+		teamSlug:     c.teamSlug,
+		usePreflight: c.usePreflight,
+	}
+	client.HTTPClient.CheckRetry = client.checkRetry
+	return client
+}
+
+// WithoutRetries returns a copy of the client that sends each request only once, and hands
+// every response back to the caller, for callers that retry requests themselves. Its failed
+// and timed out requests don't count towards the remote cache's limit of failures.
+func (c *APIClient) WithoutRetries() *APIClient {
+	client := c.WithTransport(c.HTTPClient.HTTPClient.Transport)
+	client.HTTPClient.RetryMax = 0
+	client.HTTPClient.CheckRetry = noRetry
+	return client
+}
+
+// noRetry is a retryablehttp.CheckRetry that never retries
+func noRetry(ctx context.Context, _ *http.Response, _ error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	return false, nil
+}
+
 // hasUser returns true if we have credentials for a user
 func (c *APIClient) hasUser() bool {
 	return c.token != ""
@@ -199,8 +257,13 @@ func (c *APIClient) addTeamParam(params *url.Values) {
 }
 
 // JSONPatch sends a byte array (json.marshalled payload) to a given endpoint with PATCH
-func (c *APIClient) JSONPatch(endpoint string, body []byte) ([]byte, error) {
-	resp, err := c.request(endpoint, http.MethodPatch, body)
+func (c *APIClient) JSONPatch(ctx context.Context, endpoint string, body []byte) ([]byte, error) {
+	return c.JSONPatchWithHeaders(ctx, endpoint, body, nil)
+}
+
+// JSONPatchWithHeaders is JSONPatch with additional headers set on the request
+func (c *APIClient) JSONPatchWithHeaders(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error) {
+	resp, err := c.request(ctx, endpoint, http.MethodPatch, body, headers)
 	if err != nil {
 		return nil, err
 	}
@@ -210,15 +273,45 @@ func (c *APIClient) JSONPatch(endpoint string, body []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read response %v", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", string(rawResponse))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(rawResponse), Header: resp.Header}
+	}
+
+	return rawResponse, nil
+}
+
+// JSONPut sends a byte array (json.marshalled payload) to a given endpoint with PUT
+func (c *APIClient) JSONPut(ctx context.Context, endpoint string, body []byte) ([]byte, error) {
+	return c.JSONPutWithHeaders(ctx, endpoint, body, nil)
+}
+
+// JSONPutWithHeaders is JSONPut with additional headers set on the request
+func (c *APIClient) JSONPutWithHeaders(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error) {
+	resp, err := c.request(ctx, endpoint, http.MethodPut, body, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	rawResponse, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response %v", err)
+	}
+
+	// For non 200/201 status codes, return the response body as an error
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(rawResponse), Header: resp.Header}
 	}
 
 	return rawResponse, nil
 }
 
 // JSONPost sends a byte array (json.marshalled payload) to a given endpoint with POST
-func (c *APIClient) JSONPost(endpoint string, body []byte) ([]byte, error) {
-	resp, err := c.request(endpoint, http.MethodPost, body)
+func (c *APIClient) JSONPost(ctx context.Context, endpoint string, body []byte) ([]byte, error) {
+	return c.JSONPostWithHeaders(ctx, endpoint, body, nil)
+}
+
+// JSONPostWithHeaders is JSONPost with additional headers set on the request
+func (c *APIClient) JSONPostWithHeaders(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error) {
+	resp, err := c.request(ctx, endpoint, http.MethodPost, body, headers)
 	if err != nil {
 		return nil, err
 	}
@@ -230,13 +323,13 @@ func (c *APIClient) JSONPost(endpoint string, body []byte) ([]byte, error) {
 
 	// For non 200/201 status codes, return the response body as an error
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("%s", string(rawResponse))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(rawResponse), Header: resp.Header}
 	}
 
 	return rawResponse, nil
 }
 
-func (c *APIClient) request(endpoint string, method string, body []byte) (*http.Response, error) {
+func (c *APIClient) request(ctx context.Context, endpoint string, method string, body []byte, headers http.Header) (*http.Response, error) {
 	if err := c.okToRequest(); err != nil {
 		return nil, err
 	}
@@ -266,6 +359,7 @@ func (c *APIClient) request(endpoint string, method string, body []byte) (*http.
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
@@ -279,6 +373,10 @@ func (c *APIClient) request(endpoint string, method string, body []byte) (*http.
 		req.Header.Set("x-artifact-client-ci", ci.Constant())
 	}
 
+	for key, values := range headers {
+		req.Header[http.CanonicalHeaderKey(key)] = values
+	}
+
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -158,3 +159,168 @@ func Test_FetchWhenCachingDisabled(t *testing.T) {
 		t.Errorf("response got %v, want <nil>", resp)
 	}
 }
+
+func Test_JSONPostWithHeaders(t *testing.T) {
+	ch := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		ch <- req.Header
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	apiClientConfig := turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}
+	apiClient := NewClient(apiClientConfig, hclog.Default(), "v1")
+
+	headers := http.Header{"Content-Encoding": []string{"gzip"}}
+	if _, err := apiClient.JSONPostWithHeaders(context.Background(), "/v0/endpoint", []byte("{}"), headers); err != nil {
+		t.Fatalf("JSONPostWithHeaders: %v", err)
+	}
+
+	received := <-ch
+	if got := received.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding got %v, want gzip", got)
+	}
+	if got := received.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type got %v, want application/json", got)
+	}
+}
+
+func Test_JSONPostStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid payload"))
+	}))
+	defer ts.Close()
+
+	apiClientConfig := turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}
+	apiClient := NewClient(apiClientConfig, hclog.Default(), "v1")
+
+	_, err := apiClient.JSONPost(context.Background(), "/v0/endpoint", []byte("{}"))
+	statusErr := &StatusError{}
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected status error, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("status code got %v, want %v", statusErr.StatusCode, http.StatusBadRequest)
+	}
+	if got := statusErr.Header.Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After got %v, want 5", got)
+	}
+	if err.Error() != "invalid payload" {
+		t.Errorf("error got %v, want invalid payload", err)
+	}
+}
+
+func Test_JSONPut(t *testing.T) {
+	ch := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		ch <- req.Method
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	apiClientConfig := turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}
+	apiClient := NewClient(apiClientConfig, hclog.Default(), "v1")
+
+	if _, err := apiClient.JSONPut(context.Background(), "/v0/endpoint", []byte("{}")); err != nil {
+		t.Fatalf("JSONPut: %v", err)
+	}
+	if method := <-ch; method != http.MethodPut {
+		t.Errorf("method got %v, want %v", method, http.MethodPut)
+	}
+}
+
+// fakeTransport answers every request itself, recording the urls it was sent
+type fakeTransport struct {
+	urls []string
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.urls = append(f.urls, req.URL.String())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("{}"))),
+		Header:     http.Header{},
+		Request:    req,
+	}, nil
+}
+
+func Test_WithTransport(t *testing.T) {
+	apiClientConfig := turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   "http://api.example.com",
+		Token:    "my-token",
+	}
+	apiClient := NewClient(apiClientConfig, hclog.Default(), "v1")
+	transport := &fakeTransport{}
+	withTransport := apiClient.WithTransport(transport)
+
+	if _, err := withTransport.JSONPostWithHeaders(context.Background(), "/v0/endpoint", []byte("{}"), nil); err != nil {
+		t.Fatalf("JSONPostWithHeaders: %v", err)
+	}
+
+	want := []string{"http://api.example.com/v0/endpoint?slug=my-team-slug"}
+	if !reflect.DeepEqual(transport.urls, want) {
+		t.Errorf("requests got %v, want %v", transport.urls, want)
+	}
+	if !withTransport.IsLinked() {
+		t.Error("expected the copy to be linked, like the original")
+	}
+	if apiClient.HTTPClient.HTTPClient.Transport != nil {
+		t.Error("expected the original client's transport to be unchanged")
+	}
+}
+
+func Test_WithoutRetries(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		requests++
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	apiClientConfig := turbostate.APIClientConfig{
+		TeamSlug: "my-team-slug",
+		APIURL:   ts.URL,
+		Token:    "my-token",
+	}
+	apiClient := NewClient(apiClientConfig, hclog.Default(), "v1").WithoutRetries()
+
+	// More failures than the remote cache allows, and every one still reaches the server
+	for i := 1; i <= 5; i++ {
+		_, err := apiClient.JSONPost(context.Background(), "/v0/endpoint", []byte("{}"))
+		statusErr := &StatusError{}
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("expected status error, got %v", err)
+		}
+		if statusErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status code got %v, want %v", statusErr.StatusCode, http.StatusServiceUnavailable)
+		}
+		if got := statusErr.Header.Get("Retry-After"); got != "5" {
+			t.Errorf("Retry-After got %v, want 5", got)
+		}
+		if requests != i {
+			t.Errorf("requests got %v, want %v", requests, i)
+		}
+	}
+}
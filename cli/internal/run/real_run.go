@@ -26,6 +26,7 @@ import (
 	"github.com/vercel/turbo/cli/internal/process"
 	"github.com/vercel/turbo/cli/internal/runcache"
 	"github.com/vercel/turbo/cli/internal/runsummary"
+	"github.com/vercel/turbo/cli/internal/signals"
 	"github.com/vercel/turbo/cli/internal/spinner"
 	"github.com/vercel/turbo/cli/internal/taskhash"
 	"github.com/vercel/turbo/cli/internal/turbopath"
@@ -48,6 +49,7 @@ func RealRun(
 	runSummary runsummary.Meta,
 	packageManager *packagemanager.PackageManager,
 	processes *process.Manager,
+	signalWatcher *signals.Watcher,
 ) error {
 	singlePackage := rs.Opts.runOpts.SinglePackage
 
@@ -123,6 +125,16 @@ func RealRun(
 		return nil
 	}
 
+	// Close isn't reached when turbo is stopped by a signal, so record the tasks that finished before it was.
+	// This runs after the task processes have been stopped.
+	signalWatcher.AddOnClose(func() {
+		mu.Lock()
+		finished := make([]*runsummary.TaskSummary, len(taskSummaries))
+		copy(finished, taskSummaries)
+		mu.Unlock()
+		runSummary.Flush(finished)
+	})
+
 	getArgs := func(taskID string) []string {
 		return rs.ArgsForTask(taskID)
 	}
@@ -173,10 +185,15 @@ func RealRun(
 	}
 
 	if err := runSummary.Close(ctx, exitCode, g.WorkspaceInfos); err != nil {
-		// We don't need to throw an error, but we can warn on this.
-		// Note: this method doesn't actually return an error for Real Runs at the time of writing.
+		// With TURBO_SPACES_STRICT, a run that couldn't be recorded to Spaces fails,
+		// unless it already failed for another reason.
+		if errors.Is(err, runsummary.ErrSpacesUploadFailed) && exitCode == 0 {
+			return err
+		}
+		// Otherwise we don't need to throw an error, but we can warn on this.
 		base.UI.Info(fmt.Sprintf("Failed to close Run Summary %v", err))
 	}
+	runSummary.PrintSpacesSummary()
 
 	if exitCode != 0 {
 		return &process.ChildExit{
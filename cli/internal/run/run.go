@@ -71,6 +71,7 @@ func optsFromArgs(args *turbostate.ParsedArgsFromRust) (*Opts, error) {
 	opts.runOpts.LogPrefix = runPayload.LogPrefix
 	opts.runOpts.Summarize = runPayload.Summarize
 	opts.runOpts.ExperimentalSpaceID = runPayload.ExperimentalSpaceID
+	opts.runOpts.DrySpaces = runPayload.DrySpaces
 	opts.runOpts.EnvMode = runPayload.EnvMode
 	opts.runOpts.FrameworkInference = runPayload.FrameworkInference
 
@@ -134,16 +135,18 @@ func configureRun(base *cmdutil.CmdBase, opts *Opts, signalWatcher *signals.Watc
 	processes := process.NewManager(base.Logger.Named("processes"))
 	signalWatcher.AddOnClose(processes.Close)
 	return &run{
-		base:      base,
-		opts:      opts,
-		processes: processes,
+		base:          base,
+		opts:          opts,
+		processes:     processes,
+		signalWatcher: signalWatcher,
 	}
 }
 
 type run struct {
-	base      *cmdutil.CmdBase
-	opts      *Opts
-	processes *process.Manager
+	base          *cmdutil.CmdBase
+	opts          *Opts
+	processes     *process.Manager
+	signalWatcher *signals.Watcher
 }
 
 func (r *run) run(ctx gocontext.Context, targets []string, executionState *turbostate.ExecutionState) error {
@@ -380,6 +383,8 @@ func (r *run) run(ctx gocontext.Context, targets []string, executionState *turbo
 		),
 		rs.Opts.SynthesizeCommand(rs.Targets),
 	)
+	summary.SetSpacesLogger(r.base.Logger.Named("spaces"))
+	summary.SetPackageManager(packageManager.Slug)
 
 	// Dry Run
 	if rs.Opts.runOpts.DryRun {
@@ -413,6 +418,7 @@ func (r *run) run(ctx gocontext.Context, targets []string, executionState *turbo
 		// Extra arg only for regular runs, dry-run doesn't get this
 		packageManager,
 		r.processes,
+		r.signalWatcher,
 	)
 }
 
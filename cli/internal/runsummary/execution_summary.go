@@ -74,6 +74,7 @@ type TaskExecutionSummary struct {
 	err      string             // only populated for failure statuses
 	Duration time.Duration      // updated during the task execution
 	exitCode *int               // pointer so we can distinguish between 0 and unknown.
+	attempts int                // number of times the task started building
 }
 
 func (ts *TaskExecutionSummary) endTime() time.Time {
@@ -98,6 +99,26 @@ func (ts *TaskExecutionSummary) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&serializable)
 }
 
+// UnmarshalJSON reads a TaskExecutionSummary back from the format written by MarshalJSON,
+// e.g. to record a saved run summary to Spaces. The number of attempts isn't saved.
+func (ts *TaskExecutionSummary) UnmarshalJSON(data []byte) error {
+	serializable := struct {
+		Start    int64  `json:"startTime"`
+		End      int64  `json:"endTime"`
+		Err      string `json:"error,omitempty"`
+		ExitCode *int   `json:"exitCode"`
+	}{}
+	if err := json.Unmarshal(data, &serializable); err != nil {
+		return err
+	}
+
+	ts.startAt = time.UnixMilli(serializable.Start)
+	ts.Duration = time.UnixMilli(serializable.End).Sub(ts.startAt)
+	ts.err = serializable.Err
+	ts.exitCode = serializable.ExitCode
+	return nil
+}
+
 // ExitCode access exit code nil means no exit code was received
 func (ts *TaskExecutionSummary) ExitCode() *int {
 	var exitCode int
@@ -155,6 +176,37 @@ func (es *executionSummary) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&serializable)
 }
 
+// UnmarshalJSON reads an executionSummary back from the format written by MarshalJSON,
+// e.g. to record a saved run summary to Spaces
+func (es *executionSummary) UnmarshalJSON(data []byte) error {
+	serializable := struct {
+		Command   string `json:"command"`
+		RepoPath  string `json:"repoPath"`
+		Success   int    `json:"success"`
+		Failure   int    `json:"failed"`
+		Cached    int    `json:"cached"`
+		Attempted int    `json:"attempted"`
+		StartTime int64  `json:"startTime"`
+		EndTime   int64  `json:"endTime"`
+		ExitCode  int    `json:"exitCode"`
+	}{}
+	if err := json.Unmarshal(data, &serializable); err != nil {
+		return err
+	}
+
+	es.command = serializable.Command
+	es.repoPath = turbopath.RelativeSystemPathFromUpstream(serializable.RepoPath)
+	es.success = serializable.Success
+	es.failure = serializable.Failure
+	es.cached = serializable.Cached
+	es.attempted = serializable.Attempted
+	es.startedAt = time.UnixMilli(serializable.StartTime)
+	es.endedAt = time.UnixMilli(serializable.EndTime)
+	es.exitCode = serializable.ExitCode
+	es.tasks = make(map[string]*TaskExecutionSummary)
+	return nil
+}
+
 // newExecutionSummary creates a executionSummary instance to track events in a `turbo run`.`
 func newExecutionSummary(command string, repoPath turbopath.RelativeSystemPath, start time.Time, tracingProfile string) *executionSummary {
 	if tracingProfile != "" {
@@ -212,6 +264,33 @@ func (es *executionSummary) run(taskID string) (func(outcome executionEventName,
 	return tracerFn, taskExecutionSummary
 }
 
+// finish sets how the run ended. Flush can read the summary at the same time, from the signal watcher.
+func (es *executionSummary) finish(exitCode int, endedAt time.Time) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.exitCode = exitCode
+	es.endedAt = endedAt
+}
+
+// snapshot copies the counts and times of the run so far, for recording a run that hasn't finished.
+// Tasks aren't copied.
+func (es *executionSummary) snapshot(endedAt time.Time) *executionSummary {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	return &executionSummary{
+		command:   es.command,
+		repoPath:  es.repoPath,
+		success:   es.success,
+		failure:   es.failure,
+		cached:    es.cached,
+		attempted: es.attempted,
+		startedAt: es.startedAt,
+		endedAt:   endedAt,
+		exitCode:  es.exitCode,
+	}
+}
+
 func (es *executionSummary) add(event *executionEvent) *TaskExecutionSummary {
 	es.mu.Lock()
 	defer es.mu.Unlock()
@@ -238,6 +317,7 @@ func (es *executionSummary) add(event *executionEvent) *TaskExecutionSummary {
 
 	switch {
 	case event.Status == TargetBuilding:
+		taskExecSummary.attempts++
 		es.attempted++
 	case event.Status == TargetBuildFailed:
 		es.failure++
@@ -4,16 +4,27 @@ package runsummary
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/cli"
 	"github.com/segmentio/ksuid"
+	"github.com/vercel/turbo/cli/internal/cache"
 	"github.com/vercel/turbo/cli/internal/ci"
 	"github.com/vercel/turbo/cli/internal/client"
 	"github.com/vercel/turbo/cli/internal/env"
+	"github.com/vercel/turbo/cli/internal/fs"
 	"github.com/vercel/turbo/cli/internal/spinner"
 	"github.com/vercel/turbo/cli/internal/turbopath"
 	"github.com/vercel/turbo/cli/internal/util"
@@ -32,9 +43,6 @@ const NoFrameworkDetected = "<NO FRAMEWORK DETECTED>"
 const FrameworkDetectionSkipped = "<FRAMEWORK DETECTION SKIPPED>"
 
 const runSummarySchemaVersion = "0"
-const runsEndpoint = "/v0/spaces/%s/runs"
-const runsPatchEndpoint = "/v0/spaces/%s/runs/%s"
-const tasksEndpoint = "/v0/spaces/%s/runs/%s/tasks"
 
 type runType int
 
@@ -53,10 +61,36 @@ type Meta struct {
 	repoPath           turbopath.RelativeSystemPath
 	singlePackage      bool
 	shouldSave         bool
-	apiClient          *client.APIClient
+	spacesClient       *spacesClient
+	logRedactor        *logRedactor
+	maxLogBytes        int    // task logs sent to Spaces are truncated to this size
+	sendHashInputs     bool   // whether task payloads for Spaces include what went into the hash
+	uploadLogs         bool   // whether task payloads for Spaces include the task's logs
+	skipCacheHits      bool   // whether tasks restored from the cache are left out of Spaces
+	sendGraph          bool   // whether the run's task graph is sent to Spaces
+	sendSummary        bool   // whether the whole run summary is sent to Spaces, as it's written by --summarize
+	sendTaskStats      bool   // whether timings of the run's tasks, grouped by task name, are sent to Spaces
+	spacesRecorded     bool   // whether the run was sent to its Space, successfully or not
+	spacesRunURL       string // the url of the run in its Space, once it has been created
+	interrupted        bool   // whether this is the partial run recorded by Flush
 	spaceID            string
+	mirrorSpaceIDs     []string // additional Spaces that the run is also recorded to
+	ciJobURL           string   // link to the CI job the run is part of, if any
+	runContext         string   // where the run happened, either a CI vendor, "CI" or "LOCAL"
+	runName            string   // what the run is called in its Space, if not its command
+	packageManager     string   // the slug of the repo's package manager
+	labels             []string // tags for filtering runs in the Space
+	workspaceCount     int      // set from the workspaces passed to Close
+	strictSpaces       bool     // whether Close fails when the run couldn't be recorded to Spaces
+	existingRunID      string   // a run created by an earlier invocation, that tasks are added to instead of creating a new run
 	runType            runType
 	synthesizedCommand string
+	onRunCreated       func(runID string, runURL string)
+	payloadTransforms  []SpacesPayloadTransform
+	logLineFilter      func(line []byte) bool
+	taskLimit          spacesTaskLimit
+	daemonEnabled      bool
+	finishExistingRun  bool
 }
 
 // RunSummary contains a summary of what happens in the `turbo run` command and why.
@@ -104,6 +138,56 @@ func NewRunSummary(
 	executionSummary := newExecutionSummary(synthesizedCommand, repoPath, startAt, profile)
 
 	envVars := env.GetEnvMap()
+	spacesClient := newSpacesClient(apiClient, envVars)
+	spacesClient.dryRun = runOpts.DrySpaces
+	spacesClient.ui = ui
+	spacesClient.setUserAgent(turboVersion)
+	sendHashInputs, _ := strconv.ParseBool(envVars[spacesVerboseEnvVar])
+	strictSpaces, _ := strconv.ParseBool(envVars[spacesStrictEnvVar])
+	skipCacheHits, _ := strconv.ParseBool(envVars[spacesSkipCacheHitsEnvVar])
+	sendGraph, _ := strconv.ParseBool(envVars[spacesSendGraphEnvVar])
+	sendSummary, _ := strconv.ParseBool(envVars[spacesSendSummaryEnvVar])
+	sendTaskStats, _ := strconv.ParseBool(envVars[spacesSendTaskStatsEnvVar])
+	finishExistingRun, _ := strconv.ParseBool(envVars[spacesFinishRunEnvVar])
+	scmSummary := getSCMState(envVars, repoRoot)
+	taskLimit := spacesTaskLimit{}
+	var labels []string
+
+	// The rest of the Spaces settings are only read for runs that are recorded to a Space,
+	// so that stray environment variables don't cause warnings on every other run
+	if spaceID != "" && runType == runTypeReal {
+		spacesClient.useAPIClient(apiClient, envVars, ui)
+		spacesClient.failedRequestsPath = getSpacesFailedRequestsPath(repoRoot)
+		if auditFile := envVars[spacesAuditFileEnvVar]; auditFile != "" {
+			spacesClient.auditPath = fs.ResolveUnknownPath(repoRoot, auditFile)
+		}
+
+		var err error
+		if taskLimit, err = getSpacesTaskLimit(envVars); err != nil {
+			ui.Warn(fmt.Sprintf("Sending every task to Spaces: %v", err))
+		}
+		branchFilter, branchErrs := getSpacesBranchFilter(envVars)
+		for _, err := range branchErrs {
+			ui.Warn(fmt.Sprintf("Ignoring Spaces branch pattern: %v", err))
+		}
+		if !branchFilter.allows(scmSummary.Branch) {
+			// Runs on other branches are left out of Spaces, the same as when Spaces is turned off
+			spacesClient.disabled = true
+		}
+		if !spacesClient.disabled {
+			scmSummary.addSpacesDetails(repoRoot)
+		}
+		var labelErrs []error
+		labels, labelErrs = getSpacesLabels(envVars)
+		for _, err := range labelErrs {
+			ui.Warn(fmt.Sprintf("Ignoring Spaces label: %v", err))
+		}
+	}
+	uploadLogs := true
+	if upload, err := strconv.ParseBool(envVars[spacesUploadLogsEnvVar]); err == nil {
+		uploadLogs = upload
+	}
+
 	return Meta{
 		RunSummary: &RunSummary{
 			ID:                 ksuid.New(),
@@ -115,7 +199,7 @@ func NewRunSummary(
 			FrameworkInference: runOpts.FrameworkInference,
 			Tasks:              []*TaskSummary{},
 			GlobalHashSummary:  globalHashSummary,
-			SCM:                getSCMState(envVars, repoRoot),
+			SCM:                scmSummary,
 			User:               getUser(envVars, repoRoot),
 		},
 		ui:                 ui,
@@ -123,12 +207,43 @@ func NewRunSummary(
 		repoRoot:           repoRoot,
 		singlePackage:      singlePackage,
 		shouldSave:         shouldSave,
-		apiClient:          apiClient,
+		spacesClient:       spacesClient,
+		logRedactor:        newLogRedactor(envVars),
+		maxLogBytes:        _defaultMaxLogBytes,
+		sendHashInputs:     sendHashInputs,
+		uploadLogs:         uploadLogs,
+		skipCacheHits:      skipCacheHits,
+		sendGraph:          sendGraph,
+		sendSummary:        sendSummary,
+		sendTaskStats:      sendTaskStats,
+		taskLimit:          taskLimit,
+		daemonEnabled:      !runOpts.NoDaemon,
 		spaceID:            spaceID,
+		mirrorSpaceIDs:     getSpacesMirrorIDs(envVars, spaceID),
+		ciJobURL:           getCIJobURL(envVars),
+		runName:            strings.TrimSpace(envVars[spacesRunNameEnvVar]),
+		runContext:         getRunContext(envVars, ci.Info()),
+		labels:             labels,
+		existingRunID:      envVars[spacesRunIDEnvVar],
+		finishExistingRun:  finishExistingRun,
+		strictSpaces:       strictSpaces,
 		synthesizedCommand: synthesizedCommand,
 	}
 }
 
+// RedactLogPatterns masks anything matching the given patterns in task logs sent to Spaces.
+// The values of secret-looking environment variables are always masked.
+func (rsm *Meta) RedactLogPatterns(patterns ...*regexp.Regexp) {
+	rsm.logRedactor.patterns = append(rsm.logRedactor.patterns, patterns...)
+}
+
+// SetLogLineFilter leaves lines for which keep returns false out of task logs sent to Spaces,
+// e.g. to drop progress output. keep is given each line without its line ending, and is called
+// from several goroutines at once. The logs written to disk aren't changed.
+func (rsm *Meta) SetLogLineFilter(keep func(line []byte) bool) {
+	rsm.logLineFilter = keep
+}
+
 // getPath returns a path to where the runSummary is written.
 // The returned path will always be relative to the dir passsed in.
 // We don't do a lot of validation, so `../../` paths are allowed.
@@ -143,8 +258,8 @@ func (rsm *Meta) Close(ctx context.Context, exitCode int, workspaceInfos workspa
 		return rsm.closeDryRun(workspaceInfos)
 	}
 
-	rsm.RunSummary.ExecutionSummary.exitCode = exitCode
-	rsm.RunSummary.ExecutionSummary.endedAt = time.Now()
+	rsm.RunSummary.ExecutionSummary.finish(exitCode, time.Now())
+	rsm.workspaceCount = countWorkspaces(workspaceInfos)
 
 	summary := rsm.RunSummary
 	if err := writeChrometracing(summary.ExecutionSummary.profileFilename, rsm.ui); err != nil {
@@ -170,43 +285,245 @@ func (rsm *Meta) Close(ctx context.Context, exitCode int, workspaceInfos workspa
 		return nil
 	}
 
-	return rsm.sendToSpace(ctx)
+	// Flush already recorded the run if turbo was stopped by a signal. The summary is still
+	// saved and printed above, since Flush only records the run to its Space.
+	if !rsm.spacesClient.startFinalizing() {
+		return nil
+	}
+	defer rsm.spacesClient.finishFinalizing()
+
+	if err := rsm.sendToSpace(ctx); err != nil {
+		return err
+	}
+
+	// By default a run that couldn't be recorded doesn't fail. The errors are only reported.
+	if errs := rsm.SpacesErrors(); rsm.strictSpaces && len(errs) > 0 {
+		return fmt.Errorf("%w: %v", ErrSpacesUploadFailed, multierror.Append(nil, errs...))
+	}
+	return nil
+}
+
+// Flush records the run to its Space with the tasks that have finished so far, and marks it as
+// interrupted. It's for when turbo is stopped by a signal, and Close won't be reached.
+// Only the first of Close and Flush records the run. If Close is already recording it,
+// Flush waits for Close to finish instead. Either way, Flush waits at most spacesFlushTimeout.
+func (rsm *Meta) Flush(tasks []*TaskSummary) {
+	if rsm.spaceID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spacesFlushTimeout)
+	defer cancel()
+
+	if !rsm.spacesClient.startFinalizing() {
+		select {
+		case <-rsm.spacesClient.finalized:
+		case <-ctx.Done():
+		}
+		return
+	}
+	defer rsm.spacesClient.finishFinalizing()
+
+	// The run is still going, so it's recorded from a copy rather than changing the summary underneath it.
+	// Close may be running at the same time, so the fields it sets, like workspaceCount, aren't copied.
+	flushed := Meta{
+		ui:                 rsm.ui,
+		repoRoot:           rsm.repoRoot,
+		repoPath:           rsm.repoPath,
+		singlePackage:      rsm.singlePackage,
+		spacesClient:       rsm.spacesClient,
+		logRedactor:        rsm.logRedactor,
+		maxLogBytes:        rsm.maxLogBytes,
+		sendHashInputs:     rsm.sendHashInputs,
+		uploadLogs:         rsm.uploadLogs,
+		skipCacheHits:      rsm.skipCacheHits,
+		sendGraph:          rsm.sendGraph,
+		sendSummary:        rsm.sendSummary,
+		sendTaskStats:      rsm.sendTaskStats,
+		interrupted:        true,
+		spaceID:            rsm.spaceID,
+		mirrorSpaceIDs:     rsm.mirrorSpaceIDs,
+		ciJobURL:           rsm.ciJobURL,
+		runContext:         rsm.runContext,
+		runName:            rsm.runName,
+		packageManager:     rsm.packageManager,
+		labels:             rsm.labels,
+		strictSpaces:       rsm.strictSpaces,
+		existingRunID:      rsm.existingRunID,
+		runType:            rsm.runType,
+		synthesizedCommand: rsm.synthesizedCommand,
+		onRunCreated:       rsm.onRunCreated,
+		payloadTransforms:  rsm.payloadTransforms,
+		logLineFilter:      rsm.logLineFilter,
+		taskLimit:          rsm.taskLimit,
+		daemonEnabled:      rsm.daemonEnabled,
+		finishExistingRun:  rsm.finishExistingRun,
+	}
+	flushed.RunSummary = &RunSummary{
+		ID:                 rsm.RunSummary.ID,
+		Version:            rsm.RunSummary.Version,
+		TurboVersion:       rsm.RunSummary.TurboVersion,
+		GlobalHashSummary:  rsm.RunSummary.GlobalHashSummary,
+		Packages:           rsm.RunSummary.Packages,
+		EnvMode:            rsm.RunSummary.EnvMode,
+		FrameworkInference: rsm.RunSummary.FrameworkInference,
+		ExecutionSummary:   rsm.RunSummary.ExecutionSummary.snapshot(time.Now()),
+		Tasks:              tasks,
+		User:               rsm.RunSummary.User,
+		SCM:                rsm.RunSummary.SCM,
+	}
+	_ = flushed.sendToSpace(ctx)
+}
+
+// CloseWithError is Close, but also returns the errors from recording the run to its Space
+// as a single error, for callers that want to fail when the run couldn't be recorded.
+func (rsm *Meta) CloseWithError(ctx context.Context, exitCode int, workspaceInfos workspace.Catalog) error {
+	if err := rsm.Close(ctx, exitCode, workspaceInfos); err != nil {
+		return err
+	}
+	return multierror.Append(nil, rsm.SpacesErrors()...).ErrorOrNil()
+}
+
+// CloseWithTimeout is Close, but gives up on recording the run after timeout, and returns
+// ErrCloseTimeout if it did. The context passed to Close is cancelled at the deadline, so no more
+// requests are started and Close stops waiting for the ones in flight. Anything still running
+// is abandoned rather than waited for, which is only safe because turbo is about to exit, so rsm
+// shouldn't be used afterwards.
+func (rsm *Meta) CloseWithTimeout(ctx context.Context, timeout time.Duration, exitCode int, workspaceInfos workspace.Catalog) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Buffered, so that an abandoned Close can still return without blocking forever
+	closed := make(chan error, 1)
+	go func() {
+		closed <- rsm.Close(ctx, exitCode, workspaceInfos)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-closed:
+	case <-timer.C:
+		// Close may have finished just as the timer fired
+		select {
+		case err = <-closed:
+		default:
+			return fmt.Errorf("%w after %v", ErrCloseTimeout, timeout)
+		}
+	}
+
+	// Close returns once the deadline passes, even if the run is still being recorded
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && rsm.recordingAbandoned() {
+		return fmt.Errorf("%w after %v", ErrCloseTimeout, timeout)
+	}
+	return err
+}
+
+// recordingAbandoned returns whether Close stopped waiting for the run to be recorded
+func (rsm *Meta) recordingAbandoned() bool {
+	for _, err := range rsm.SpacesErrors() {
+		if errors.Is(err, ErrRecordingAbandoned) {
+			return true
+		}
+	}
+	return false
 }
 
 func (rsm *Meta) sendToSpace(ctx context.Context) error {
-	if !rsm.apiClient.IsLinked() {
-		rsm.ui.Warn("Failed to post to space because repo is not linked to a Space. Run `turbo link` first.")
+	if rsm.spacesClient.disabled {
+		return nil
+	}
+
+	// Dry runs don't talk to the API, so they don't need a linked repo
+	if !rsm.spacesClient.dryRun && !rsm.spacesClient.linked {
+		rsm.ui.Warn(fmt.Sprintf("Runs are configured to be recorded to Space %v, but this repo is not linked to Spaces. Run `turbo link --target=spaces` first.", rsm.spaceID))
+		rsm.spacesClient.setErrors([]error{ErrNotLinked})
 		return nil
 	}
 
-	// Wrap the record function so we can hoist out url/errors but keep
+	// Wrap the record function so we can hoist out errors but keep
 	// the function signature/type the spinner.WaitFor expects.
-	var url string
-	var errs []error
+	// The url is printed by record as soon as the run is created.
+	// The spinner stops waiting once ctx is done, while record can still be running,
+	// so its results are handed over on a channel rather than set from inside it.
+	type recordResult struct {
+		runURL string
+		errs   []error
+	}
+	recorded := make(chan recordResult, 1)
 	record := func() {
-		url, errs = rsm.record()
+		rsm.replayFailedRequests(ctx)
+		runURL, errs := rsm.record(ctx)
+		recorded <- recordResult{runURL: runURL, errs: errs}
 	}
 
 	func() {
 		_ = spinner.WaitFor(ctx, record, rsm.ui, "...sending run summary...", 1000*time.Millisecond)
 	}()
 
-	// After the spinner is done, print any errors and the url
-	if len(errs) > 0 {
-		rsm.ui.Warn("Errors recording run to Spaces")
-		for _, err := range errs {
-			rsm.ui.Warn(fmt.Sprintf("%v", err))
+	var errs []error
+	select {
+	case result := <-recorded:
+		rsm.spacesRunURL, errs = result.runURL, result.errs
+	default:
+		// record still marks the run as cancelled once ctx is done, and turbo may exit as soon as
+		// this returns, so that's waited for. Nothing waits for the rest of the run after that.
+		timer := time.NewTimer(rsm.spacesClient.abortTimeout)
+		defer timer.Stop()
+		select {
+		case result := <-recorded:
+			rsm.spacesRunURL, errs = result.runURL, result.errs
+		case <-timer.C:
+			errs = []error{fmt.Errorf("%w: %v", ErrRecordingAbandoned, ctx.Err())}
 		}
 	}
 
-	if url != "" {
-		rsm.ui.Output(fmt.Sprintf("Run: %s", url))
-		rsm.ui.Output("")
+	if rsm.spacesClient.auditPath != "" {
+		if err := rsm.spacesClient.audit.write(rsm.spacesClient.auditPath); err != nil {
+			rsm.ui.Warn(fmt.Sprintf("Error writing Spaces audit file: %v", err))
+		}
 	}
 
+	// After the spinner is done, print any errors
+	rsm.spacesRecorded = true
+	rsm.spacesClient.setErrors(errs)
+	printSpacesErrors(rsm.ui, errs, len(rsm.spacesTaskSummaries())*(1+len(rsm.mirrorSpaceIDs)), rsm.spacesClient.traceID)
+
 	return nil
 }
 
+// replayFailedRequests sends the requests that earlier runs couldn't deliver before this run is
+// recorded. Runs that are being flushed or printed instead of sent leave them for the next run.
+func (rsm *Meta) replayFailedRequests(ctx context.Context) {
+	if rsm.interrupted || rsm.spacesClient.dryRun {
+		return
+	}
+	replayed, errs := rsm.spacesClient.replayFailedRequests(ctx)
+	if len(errs) > 0 {
+		rsm.ui.Warn(fmt.Sprintf("Failed to replay %v of %v saved requests to Spaces: %v", len(errs), replayed, multierror.Append(nil, errs...)))
+	}
+}
+
+// SendRunSummary records the run to its Space and returns any errors from doing so
+// as a single error. Close does the same, but only reports the errors, so this is
+// for callers that want to fail when the run couldn't be recorded.
+func SendRunSummary(ctx context.Context, rsm *Meta) error {
+	if err := rsm.sendToSpace(ctx); err != nil {
+		return err
+	}
+	return multierror.Append(nil, rsm.SpacesErrors()...).ErrorOrNil()
+}
+
+// printRunURL prints the url for the run in the Space, if there is one
+func (rsm *Meta) printRunURL(runURL string) {
+	if runURL == "" {
+		return
+	}
+	rsm.ui.Output(fmt.Sprintf("Run: %s", runURL))
+	rsm.ui.Output("")
+}
+
 // closeDryRun wraps up the Run Summary at the end of `turbo run --dry`.
 // Ideally this should be inlined into Close(), but RunSummary doesn't currently
 // have context about whether a run was real or dry.
@@ -248,55 +565,307 @@ func (rsm *Meta) save() error {
 	return summaryPath.WriteFile(json, 0644)
 }
 
-// record sends the summary to the API
-func (rsm *Meta) record() (string, []error) {
-	errs := []error{}
+// PrintSpacesSummary writes a line about how much of the run was recorded to its Space,
+// e.g. "Spaces: uploaded 120 tasks to <url> (2 failed)". It is meant to be called after Close,
+// and doesn't write anything if the run wasn't sent to a Space.
+func (rsm *Meta) PrintSpacesSummary() {
+	if !rsm.spacesRecorded {
+		return
+	}
+
+	failed := 0
+	for _, err := range rsm.SpacesErrors() {
+		taskErr := &spacesTaskError{}
+		if errors.As(err, &taskErr) {
+			failed++
+		}
+	}
+	// Only the run in the primary Space is linked to, so mirrors aren't counted
+	posted := rsm.spacesClient.postedTasks(rsm.spaceID)
+	rsm.ui.Output(formatSpacesSummary(posted, failed, rsm.spacesRunURL))
+}
+
+// formatSpacesSummary composes the line written by PrintSpacesSummary
+func formatSpacesSummary(posted int, failed int, runURL string) string {
+	var summary strings.Builder
+	summary.WriteString("Spaces: ")
+	if posted == 0 && failed == 0 {
+		summary.WriteString("recorded run with no tasks")
+	} else {
+		noun := "tasks"
+		if posted == 1 {
+			noun = "task"
+		}
+		summary.WriteString(fmt.Sprintf("uploaded %v %v", posted, noun))
+	}
+	if runURL != "" {
+		summary.WriteString(" to " + runURL)
+	}
+	if failed > 0 {
+		summary.WriteString(fmt.Sprintf(" (%v failed)", failed))
+	}
+	return summary.String()
+}
+
+// SetSpacesHeader sets a header to send with every request to Spaces,
+// e.g. for a proxy in front of the Spaces API that needs to identify the team.
+func (rsm *Meta) SetSpacesHeader(key string, value string) {
+	rsm.spacesClient.headers.Set(key, value)
+}
+
+// SetPackageManager records the package manager the repo uses, e.g. "npm", with the run in its Space
+func (rsm *Meta) SetPackageManager(slug string) {
+	rsm.packageManager = slug
+}
 
-	// Right now we'll send the POST to create the Run and the subsequent task payloads
-	// after all execution is done, but in the future, this first POST request
-	// can happen when the Run actually starts, so we can send updates to the associated Space
-	// as tasks complete.
-	createRunEndpoint := fmt.Sprintf(runsEndpoint, rsm.spaceID)
+// SetSpacesRunName gives the run a name to show in its Space, e.g. "Nightly build", in place
+// of its command. It overrides TURBO_SPACES_RUN_NAME.
+func (rsm *Meta) SetSpacesRunName(name string) {
+	rsm.runName = strings.TrimSpace(name)
+}
+
+// spacesRunName returns the name of the run in its Space, which is its command unless it was named
+func (rsm *Meta) spacesRunName() string {
+	if rsm.runName != "" {
+		return rsm.runName
+	}
+	return rsm.synthesizedCommand
+}
+
+// SetSpacesLogger sets the logger that requests to Spaces are logged to. Requests are only
+// logged at debug level, so they aren't shown unless turbo is run verbosely.
+func (rsm *Meta) SetSpacesLogger(logger hclog.Logger) {
+	rsm.spacesClient.logger = logger
+}
+
+// OnSpacesTaskPosted registers a function that is called each time a task summary is sent to a
+// Space, with the number of tasks sent so far and the number to send, e.g. to show progress.
+// The count starts over for each Space the run is recorded to. It's called from multiple goroutines.
+func (rsm *Meta) OnSpacesTaskPosted(callback func(posted int, total int)) {
+	rsm.spacesClient.onTaskPosted = callback
+}
+
+// OnSpacesRunCreated registers a function that is called with the ID and url of the run
+// once it has been created in its Space, e.g. to link to it from a pull request. It isn't
+// called if the run couldn't be created, or if tasks are added to an existing run.
+func (rsm *Meta) OnSpacesRunCreated(callback func(runID string, runURL string)) {
+	rsm.onRunCreated = callback
+}
+
+// SpacesStats returns timings for the requests made to record the run to a Space
+func (rsm *Meta) SpacesStats() SpacesStats {
+	return rsm.spacesClient.stats.summary()
+}
+
+// SpacesErrors returns the errors from recording the run to a Space, if any.
+// These are only reported to the user by Close, so that a failure to record
+// doesn't fail the run, but callers can inspect them to decide otherwise.
+// The returned slice is a copy, and it's safe to call while the run is being closed.
+func (rsm *Meta) SpacesErrors() []error {
+	return rsm.spacesClient.errors()
+}
+
+// record sends the summary to the run's Space, and then to each of its mirrors.
+// It returns the url of the run in the first Space. Errors from mirrors are
+// wrapped in spacesTargetError so they can be told apart.
+func (rsm *Meta) record(ctx context.Context) (string, []error) {
+	runURL, errs := rsm.recordToSpace(ctx, rsm.spaceID)
+	for _, mirror := range rsm.mirrorSpaceIDs {
+		_, mirrorErrs := rsm.recordToSpace(ctx, mirror)
+		for _, err := range mirrorErrs {
+			errs = append(errs, &spacesTargetError{spaceID: mirror, err: err})
+		}
+	}
+
+	return runURL, errs
+}
+
+// recordToSpace sends the summary to the given Space
+func (rsm *Meta) recordToSpace(ctx context.Context, spaceID string) (string, []error) {
+	if err := validateSpaceID(spaceID); err != nil {
+		return "", []error{err}
+	}
+
+	ctx, span := rsm.spacesClient.tracer.Start(ctx, spacesRecordSpan)
+	defer span.End()
+	span.SetAttribute("spaces.space_id", spaceID)
+	span.SetAttribute("spaces.trace_id", rsm.spacesClient.traceID)
+
+	errs := []error{}
 	response := &spacesRunResponse{}
+	// A run created by an earlier invocation is shared with other invocations, e.g. CI shards, so
+	// it's only kept alive and marked as done or cancelled by the invocation that's asked to finish it
+	finishRun := true
 
-	payload := rsm.newSpacesRunCreatePayload()
-	if startPayload, err := json.Marshal(payload); err == nil {
-		if resp, err := rsm.apiClient.JSONPost(createRunEndpoint, startPayload); err != nil {
-			errs = append(errs, fmt.Errorf("POST %s: %w", createRunEndpoint, err))
-		} else {
-			if err := json.Unmarshal(resp, response); err != nil {
-				errs = append(errs, fmt.Errorf("Error unmarshaling response: %w", err))
-			}
+	if rsm.existingRunID != "" && spaceID == rsm.spaceID {
+		// The run was created by an earlier invocation, so this one only adds its tasks to it
+		if !spaceIDPattern.MatchString(rsm.existingRunID) {
+			err := fmt.Errorf("%w %q: run IDs can only contain letters, numbers, underscores and dashes", ErrInvalidRunID, rsm.existingRunID)
+			span.RecordError(err)
+			return "", []error{err}
 		}
+		response.ID = rsm.existingRunID
+		finishRun = rsm.finishExistingRun
+	} else if err := rsm.createRun(ctx, spaceID, response); err != nil {
+		errs = append(errs, err)
 	}
 
 	if response.ID != "" {
-		if taskErrs := rsm.postTaskSummaries(response.ID); len(taskErrs) > 0 {
-			errs = append(errs, taskErrs...)
+		span.SetAttribute("spaces.run_id", response.ID)
+		patchURL := rsm.spacesClient.endpoints.run(spaceID, response.ID)
+
+		stopHeartbeat := func() {}
+		if finishRun {
+			stopHeartbeat = rsm.spacesClient.startHeartbeat(ctx, patchURL)
+		}
+		if rsm.sendGraph {
+			if err := rsm.postGraph(ctx, spaceID, response.ID); err != nil {
+				errs = append(errs, err)
+			}
 		}
+		taskErrs := rsm.postTaskSummaries(ctx, spaceID, response.ID)
+		errs = append(errs, taskErrs...)
+		if rsm.sendTaskStats && ctx.Err() == nil {
+			if err := rsm.postTaskStats(ctx, spaceID, response.ID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if rsm.sendSummary && ctx.Err() == nil {
+			if err := rsm.postSummary(ctx, spaceID, response.ID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		stopHeartbeat()
 
-		if donePayload, err := json.Marshal(newSpacesDonePayload(rsm.RunSummary)); err == nil {
-			patchURL := fmt.Sprintf(runsPatchEndpoint, rsm.spaceID, response.ID)
-			if _, err := rsm.apiClient.JSONPatch(patchURL, donePayload); err != nil {
-				errs = append(errs, fmt.Errorf("PATCH %s: %w", patchURL, err))
+		switch {
+		case !finishRun:
+			// The run is left as it is for the invocation that finishes it
+		case ctx.Err() != nil:
+			// We were interrupted before every task was sent. Mark the run as
+			// cancelled so that it isn't left running in the Space.
+			span.SetAttribute("spaces.run_status", spacesRunStatusCancelled)
+			if err := rsm.abortRun(patchURL); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			done := rsm.newSpacesDonePayload()
+			span.SetAttribute("spaces.run_status", done.Status)
+			if donePayload, err := rsm.marshalSpacesPayload(spacesDoneKind, done); err == nil {
+				if _, err := rsm.spacesClient.makeRequest(ctx, http.MethodPatch, patchURL, donePayload); err != nil {
+					errs = append(errs, fmt.Errorf("PATCH %s: %w", patchURL, err))
+				}
 			}
 		}
 	}
 
 	if len(errs) > 0 {
+		for _, err := range errs {
+			span.RecordError(err)
+		}
 		return response.URL, errs
 	}
 
 	return response.URL, nil
 }
 
-func (rsm *Meta) postTaskSummaries(runID string) []error {
+// createRun creates the run in the Space and reads the response into response.
+//
+// Right now we'll send the POST to create the Run and the subsequent task payloads
+// after all execution is done, but in the future, this first POST request
+// can happen when the Run actually starts, so we can send updates to the associated Space
+// as tasks complete.
+func (rsm *Meta) createRun(ctx context.Context, spaceID string, response *spacesRunResponse) error {
+	payload := rsm.newSpacesRunCreatePayload()
+	startPayload, err := rsm.marshalSpacesPayload(spacesRunKind, payload)
+	if err != nil {
+		// Without a run, none of the tasks can be sent either
+		return fmt.Errorf("%w: could not be marshaled: %v", ErrInvalidRunPayload, err)
+	}
+	// Validated after marshaling, so that it's checked as it was transformed
+	if err := payload.validateCreate(); err != nil {
+		return err
+	}
+
+	if err := rsm.spacesClient.waitToStart(ctx); err != nil {
+		return err
+	}
+
+	createRunEndpoint := rsm.spacesClient.endpoints.runs(spaceID)
+
+	// The key stays the same across retries, so a create that was received but whose response was lost isn't duplicated.
+	// A failed create isn't saved for replay, since none of the requests that would finish the run are sent without it.
+	headers := http.Header{spacesIdempotencyKeyHeader: []string{uuid.New().String()}}
+	opts := spacesRequestOptions{headers: headers, retry: &rsm.spacesClient.createRetry, skipSave: true}
+	resp, err := rsm.spacesClient.makeRequestWithOptions(ctx, http.MethodPost, createRunEndpoint, startPayload, opts)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", createRunEndpoint, err)
+	}
+	if err := json.Unmarshal(resp, response); err != nil {
+		return fmt.Errorf("Error unmarshaling response: %w", err)
+	}
+
+	// Show the url right away, so it can be followed while the rest of the run is sent
+	rsm.printRunURL(response.URL)
+	if rsm.onRunCreated != nil && response.ID != "" && spaceID == rsm.spaceID {
+		rsm.onRunCreated(response.ID, response.URL)
+	}
+	return nil
+}
+
+// abortRun marks a run as cancelled. The context for the run has already been
+// cancelled by the time this is called, so the request is made without it, and
+// is bounded by abortTimeout instead.
+func (rsm *Meta) abortRun(patchURL string) error {
+	payload, err := rsm.marshalSpacesPayload(spacesDoneKind, rsm.newSpacesCancelledPayload())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rsm.spacesClient.abortTimeout)
+	defer cancel()
+	if _, err := rsm.spacesClient.makeRequest(ctx, http.MethodPatch, patchURL, payload); err != nil {
+		return fmt.Errorf("PATCH %s: %w", patchURL, err)
+	}
+
+	return nil
+}
+
+// spacesTaskSummaries returns the tasks that are sent to Spaces. When skipCacheHits is set,
+// tasks that were restored from the cache are left out, and when the number of tasks is capped,
+// only that many are picked from the rest. Tasks that are left out are still counted in the done payload.
+func (rsm *Meta) spacesTaskSummaries() []*TaskSummary {
+	if !rsm.skipCacheHits {
+		return rsm.taskLimit.apply(rsm.RunSummary.Tasks)
+	}
+
+	taskSummaries := make([]*TaskSummary, 0, len(rsm.RunSummary.Tasks))
+	for _, task := range rsm.RunSummary.Tasks {
+		if task.CacheSummary.Status != cache.CacheEventHit {
+			taskSummaries = append(taskSummaries, task)
+		}
+	}
+	return rsm.taskLimit.apply(taskSummaries)
+}
+
+// skippedTaskCount is the number of tasks in the run that aren't sent to Spaces
+func (rsm *Meta) skippedTaskCount() int {
+	return len(rsm.RunSummary.Tasks) - len(rsm.spacesTaskSummaries())
+}
+
+// postTaskSummaries sends each task summary to the run. Once ctx is cancelled,
+// in-flight requests are allowed to finish, but no new requests are started.
+func (rsm *Meta) postTaskSummaries(ctx context.Context, spaceID string, runID string) []error {
+	if rsm.spacesClient.taskBatchSize > 0 {
+		if errs, ok := rsm.postTaskSummaryBatches(ctx, spaceID, runID); ok {
+			return errs
+		}
+	}
+
 	errs := []error{}
-	// We make at most 8 requests at a time.
-	maxParallelRequests := 8
-	taskSummaries := rsm.RunSummary.Tasks
+	maxParallelRequests := rsm.spacesClient.concurrency
+	taskSummaries := rsm.spacesTaskSummaries()
 	taskCount := len(taskSummaries)
-	taskURL := fmt.Sprintf(tasksEndpoint, rsm.spaceID, runID)
+	taskURL := rsm.spacesClient.endpoints.tasks(spaceID, runID)
 
 	parallelRequestCount := maxParallelRequests
 	if taskCount < maxParallelRequests {
@@ -305,17 +874,41 @@ func (rsm *Meta) postTaskSummaries(runID string) []error {
 
 	queue := make(chan int, taskCount)
 
+	// errsMu guards errs, which is appended to by every worker
+	errsMu := sync.Mutex{}
+	// notFound is set once the Space responds to a task summary with a 404. No more task summaries
+	// are sent to it after that. Must be used via atomic package.
+	notFound := int32(0)
 	wg := &sync.WaitGroup{}
 	for i := 0; i < parallelRequestCount; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for index := range queue {
+				if ctx.Err() != nil || atomic.LoadInt32(&notFound) == 1 {
+					return
+				}
 				task := taskSummaries[index]
-				payload := newSpacesTaskPayload(task)
-				if taskPayload, err := json.Marshal(payload); err == nil {
-					if _, err := rsm.apiClient.JSONPost(taskURL, taskPayload); err != nil {
-						errs = append(errs, fmt.Errorf("Error sending %s summary to space: %w", task.TaskID, err))
+				method, endpoint := http.MethodPost, taskURL
+				if rsm.spacesClient.taskUpsert {
+					method, endpoint = http.MethodPut, rsm.spacesClient.endpoints.task(spaceID, runID, task.TaskID)
+				}
+				payload := rsm.newSpacesTaskPayload(task)
+				if taskPayload, err := rsm.marshalSpacesPayload(spacesTaskKind, payload); err == nil {
+					if _, err := rsm.spacesClient.makeRequest(ctx, method, endpoint, taskPayload); err != nil {
+						if isNotFoundError(err) {
+							if atomic.CompareAndSwapInt32(&notFound, 0, 1) {
+								errsMu.Lock()
+								errs = append(errs, rsm.tasksNotFoundError(spaceID, runID, err))
+								errsMu.Unlock()
+							}
+							continue
+						}
+						errsMu.Lock()
+						errs = append(errs, &spacesTaskError{taskID: task.TaskID, err: err})
+						errsMu.Unlock()
+					} else {
+						rsm.spacesClient.taskPosted(spaceID, taskCount)
 					}
 				}
 			}
@@ -335,6 +928,129 @@ func (rsm *Meta) postTaskSummaries(runID string) []error {
 	return nil
 }
 
+// postGraph sends the run's task graph, so the Space can show the whole graph at once
+func (rsm *Meta) postGraph(ctx context.Context, spaceID string, runID string) error {
+	graphURL := rsm.spacesClient.endpoints.graph(spaceID, runID)
+	payload, err := rsm.marshalSpacesPayload(spacesGraphKind, rsm.newSpacesGraphPayload())
+	if err != nil {
+		return err
+	}
+
+	if _, err := rsm.spacesClient.makeRequest(ctx, http.MethodPost, graphURL, payload); err != nil {
+		return fmt.Errorf("POST %s: %w", graphURL, err)
+	}
+	return nil
+}
+
+// postTaskStats sends timings of the run's tasks grouped by task name, once every task has been sent
+func (rsm *Meta) postTaskStats(ctx context.Context, spaceID string, runID string) error {
+	statsURL := rsm.spacesClient.endpoints.taskStats(spaceID, runID)
+	payload, err := rsm.marshalSpacesPayload(spacesTaskStatsKind, rsm.newSpacesTaskStatsPayload())
+	if err != nil {
+		return err
+	}
+
+	if _, err := rsm.spacesClient.makeRequest(ctx, http.MethodPost, statsURL, payload); err != nil {
+		return fmt.Errorf("POST %s: %w", statsURL, err)
+	}
+	return nil
+}
+
+// postSummary sends the whole run summary as a single JSON document, in the same format that
+// --summarize writes to disk. It's sent as it is, without payload transforms. Like any other
+// request, it's compressed when it's large, and isn't sent at all if it's over maxPayloadBytes.
+func (rsm *Meta) postSummary(ctx context.Context, spaceID string, runID string) error {
+	summaryURL := rsm.spacesClient.endpoints.summary(spaceID, runID)
+	payload, err := rsm.FormatJSON()
+	if err != nil {
+		return err
+	}
+
+	if _, err := rsm.spacesClient.makeRequest(ctx, http.MethodPost, summaryURL, payload); err != nil {
+		return fmt.Errorf("POST %s: %w", summaryURL, err)
+	}
+	return nil
+}
+
+// tasksNotFoundError describes a 404 in response to a task summary. For a run created by an earlier
+// invocation, the run ID is most likely wrong. Otherwise the API doesn't have the tasks endpoint.
+func (rsm *Meta) tasksNotFoundError(spaceID string, runID string, err error) error {
+	if rsm.existingRunID != "" && spaceID == rsm.spaceID {
+		return fmt.Errorf("%w: run %v wasn't found in Space %v: %v", ErrInvalidRunID, runID, spaceID, err)
+	}
+	return fmt.Errorf("%w: %v", ErrTasksUnsupported, err)
+}
+
+// postTaskSummaryBatches sends task summaries in groups of taskBatchSize.
+// It returns false if the server doesn't support the batch endpoint, in which
+// case nothing was recorded and tasks should be posted individually instead.
+func (rsm *Meta) postTaskSummaryBatches(ctx context.Context, spaceID string, runID string) ([]error, bool) {
+	errs := []error{}
+	batchSize := rsm.spacesClient.taskBatchSize
+	taskSummaries := rsm.spacesTaskSummaries()
+	batchURL := rsm.spacesClient.endpoints.tasksBatch(spaceID, runID)
+
+	for start := 0; start < len(taskSummaries); start += batchSize {
+		if ctx.Err() != nil {
+			break
+		}
+
+		end := start + batchSize
+		if end > len(taskSummaries) {
+			end = len(taskSummaries)
+		}
+		batch := taskSummaries[start:end]
+
+		// Each task is marshaled on its own, so that it is transformed the same as when it's sent individually
+		payload := make([]json.RawMessage, len(batch))
+		var err error
+		for i, task := range batch {
+			if payload[i], err = rsm.marshalSpacesPayload(spacesTaskKind, rsm.newSpacesTaskPayload(task)); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		batchPayload, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+
+		if _, err := rsm.spacesClient.makeRequest(ctx, http.MethodPost, batchURL, batchPayload); err != nil {
+			if start == 0 && isNotFoundError(err) {
+				return nil, false
+			}
+			for _, task := range batch {
+				errs = append(errs, &spacesTaskError{taskID: task.TaskID, err: err})
+			}
+			continue
+		}
+
+		for range batch {
+			rsm.spacesClient.taskPosted(spaceID, len(taskSummaries))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs, true
+	}
+
+	return nil, true
+}
+
+// countWorkspaces returns the number of workspaces in the repo. The root package.json is in
+// the catalog too, but isn't counted as a workspace.
+func countWorkspaces(workspaceInfos workspace.Catalog) int {
+	count := 0
+	for name := range workspaceInfos.PackageJSONs {
+		if name != util.RootPkgName {
+			count++
+		}
+	}
+	return count
+}
+
 func getUser(envVars env.EnvironmentVariableMap, dir turbopath.AbsoluteSystemPath) string {
 	var username string
 
@@ -345,3 +1061,41 @@ func getUser(envVars env.EnvironmentVariableMap, dir turbopath.AbsoluteSystemPat
 
 	return username
 }
+
+// getRunContext returns where the run happened: the constant for the CI vendor, "CI" in a CI system
+// that isn't recognized, or "LOCAL". spacesRunContextEnvVar overrides it.
+func getRunContext(envVars env.EnvironmentVariableMap, vendor ci.Vendor) string {
+	if runContext := envVars[spacesRunContextEnvVar]; runContext != "" {
+		return runContext
+	}
+	if vendor.Constant != "" {
+		return vendor.Constant
+	}
+
+	// Most CI systems set one of these, even the ones that ci doesn't know about
+	for _, name := range []string{"CI", "CONTINUOUS_INTEGRATION"} {
+		if value := envVars[name]; value != "" && value != "false" && value != "0" {
+			return "CI"
+		}
+	}
+	return "LOCAL"
+}
+
+// getCIJobURL returns a link to the CI job the run is part of, if the CI vendor provides one
+func getCIJobURL(envVars env.EnvironmentVariableMap) string {
+	vendor := ci.Info()
+
+	// GitHub Actions doesn't provide a link to the job, but it can be put together from its parts
+	if vendor.Constant == "GITHUB_ACTIONS" {
+		server, repository, runID := envVars["GITHUB_SERVER_URL"], envVars["GITHUB_REPOSITORY"], envVars["GITHUB_RUN_ID"]
+		if server == "" || repository == "" || runID == "" {
+			return ""
+		}
+		return fmt.Sprintf("%s/%s/actions/runs/%s", server, repository, runID)
+	}
+
+	if vendor.JobURLEnvVar == "" {
+		return ""
+	}
+	return envVars[vendor.JobURLEnvVar]
+}
@@ -11,6 +11,34 @@ type scmState struct {
 	Type   string `json:"type"`
 	Sha    string `json:"sha"`
 	Branch string `json:"branch"`
+
+	// These are sent to Spaces, but aren't part of the run summary
+	commitAuthor  string
+	commitMessage string
+	refType       string // "branch", "tag" or "detached"
+	tag           string // only set when refType is "tag"
+}
+
+// Kinds of git ref that a run can be for
+const (
+	refTypeBranch   = "branch"
+	refTypeTag      = "tag"
+	refTypeDetached = "detached"
+)
+
+// getRefType returns what kind of ref was checked out for the run. CI providers
+// can report a tag name as the branch for tag builds, so a branch that matches
+// the tag on the current commit is treated as that tag.
+func getRefType(branch string, tag string, sha string) string {
+	switch {
+	case tag != "" && (branch == "" || branch == tag):
+		return refTypeTag
+	case branch != "":
+		return refTypeBranch
+	case sha != "":
+		return refTypeDetached
+	}
+	return ""
 }
 
 // getSCMState returns the sha and branch when in a git repo
@@ -38,3 +66,14 @@ func getSCMState(envVars env.EnvironmentVariableMap, dir turbopath.AbsoluteSyste
 
 	return state
 }
+
+// addSpacesDetails fills in the commit and ref details that are only sent to Spaces.
+// They take more calls to `git`, so they're only looked up for runs that are recorded.
+func (s *scmState) addSpacesDetails(dir turbopath.AbsoluteSystemPath) {
+	s.commitAuthor, s.commitMessage = scm.GetCurrentCommit(dir)
+	tag := scm.GetCurrentTag(dir)
+	s.refType = getRefType(s.Branch, tag, s.Sha)
+	if s.refType == refTypeTag {
+		s.tag = tag
+	}
+}
@@ -0,0 +1,30 @@
+package runsummary
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGetRefType(t *testing.T) {
+	testCases := []struct {
+		name   string
+		branch string
+		tag    string
+		sha    string
+		want   string
+	}{
+		{name: "branch", branch: "main", sha: "abc123", want: "branch"},
+		{name: "tagged commit on a branch", branch: "main", tag: "v1.0.0", sha: "abc123", want: "branch"},
+		{name: "tag checkout", tag: "v1.0.0", sha: "abc123", want: "tag"},
+		{name: "tag build in CI", branch: "v1.0.0", tag: "v1.0.0", sha: "abc123", want: "tag"},
+		{name: "detached HEAD", sha: "abc123", want: "detached"},
+		{name: "not a git repo", want: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, getRefType(tc.branch, tc.tag, tc.sha), tc.want)
+		})
+	}
+}
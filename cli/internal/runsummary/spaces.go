@@ -1,9 +1,960 @@
 package runsummary
 
 import (
-	"github.com/vercel/turbo/cli/internal/ci"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/mitchellh/cli"
+	"github.com/vercel/turbo/cli/internal/cache"
+	"github.com/vercel/turbo/cli/internal/client"
+	"github.com/vercel/turbo/cli/internal/env"
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"github.com/vercel/turbo/cli/internal/util"
+)
+
+const (
+	// spacesMaxAttempts is the number of times a request to Spaces is attempted
+	spacesMaxAttempts = 3
+	// spacesRetryBaseDelay is the backoff before the first retry. It doubles for each subsequent retry.
+	spacesRetryBaseDelay = 200 * time.Millisecond
+	// spacesRequestDeadline bounds the total time spent on a single request, including retries
+	spacesRequestDeadline = 30 * time.Second
+	// spacesCreateMaxAttempts, spacesCreateRetryBaseDelay and spacesCreateRequestDeadline are
+	// the same for creating a run. Nothing else can be recorded without a run, so it's retried
+	// for longer.
+	spacesCreateMaxAttempts     = 5
+	spacesCreateRetryBaseDelay  = 500 * time.Millisecond
+	spacesCreateRequestDeadline = 60 * time.Second
+	// spacesCreateMaxAttemptsEnvVar overrides the number of times creating a run is attempted
+	spacesCreateMaxAttemptsEnvVar = "TURBO_SPACES_CREATE_MAX_ATTEMPTS"
+	// spacesMaxRetryAfter caps how long a Retry-After header can make a request wait before it is retried
+	spacesMaxRetryAfter = 10 * time.Second
+	// spacesRequestTimeout bounds the time spent on a single attempt of a request
+	spacesRequestTimeout = 10 * time.Second
+	// spacesAbortTimeout bounds marking an interrupted run as cancelled, which is waited for even though the run was interrupted
+	spacesAbortTimeout = 5 * time.Second
+	// spacesFlushTimeout is how long Flush waits for a partial run to be recorded, since turbo is exiting
+	spacesFlushTimeout = 10 * time.Second
+	// spacesCompressThreshold is the size in bytes above which POST bodies are gzipped
+	spacesCompressThreshold = 4 * 1024
+	// spacesMaxPayloadBytes is the default size above which a request body isn't sent, because the API would reject it
+	spacesMaxPayloadBytes = 4 * 1024 * 1024
+	// spacesMaxPayloadBytesEnvVar overrides the size above which a request body isn't sent
+	spacesMaxPayloadBytesEnvVar = "TURBO_SPACES_MAX_PAYLOAD_BYTES"
+	// spacesConcurrency is the default number of task summaries sent at the same time
+	spacesConcurrency = 8
+	// spacesMaxConcurrency caps the number of task summaries sent at the same time
+	spacesMaxConcurrency = 64
+	// spacesMaxInFlight is the default number of requests to Spaces that can be in flight at the same time
+	spacesMaxInFlight = 16
+	// spacesMaxInFlightEnvVar overrides the number of requests to Spaces that can be in flight at the same time
+	spacesMaxInFlightEnvVar = "TURBO_SPACES_MAX_IN_FLIGHT"
+	// spacesConcurrencyEnvVar overrides the number of task summaries sent at the same time
+	spacesConcurrencyEnvVar = "TURBO_SPACES_CONCURRENCY"
+	// spacesTaskBatchSizeEnvVar opts into posting task summaries in batches of the given size
+	spacesTaskBatchSizeEnvVar = "TURBO_SPACES_TASK_BATCH_SIZE"
+	// spacesHeartbeatIntervalEnvVar opts into marking the run as still running every given number of seconds while
+	// it's sent to Spaces. The run is only created once every task has finished, so this covers the upload, not the tasks.
+	spacesHeartbeatIntervalEnvVar = "TURBO_SPACES_HEARTBEAT_INTERVAL"
+	// spacesStartJitterEnvVar opts into waiting a random number of milliseconds, up to the given value,
+	// before creating a run, so that many CI shards starting together don't create their runs at once
+	spacesStartJitterEnvVar = "TURBO_SPACES_START_JITTER_MS"
+	// spacesIdempotencyKeyHeader is sent when creating a run, so the server can tell when a retried create was already received
+	spacesIdempotencyKeyHeader = "Idempotency-Key"
+	// spacesTraceHeader carries an ID shared by every request for a run, to correlate them with the Spaces backend
+	spacesTraceHeader = "X-Turbo-Run-Trace"
+	// spacesVerboseEnvVar opts into sending what went into each task's hash
+	spacesVerboseEnvVar = "TURBO_SPACES_VERBOSE"
+	// spacesUploadLogsEnvVar can be set to false to keep task logs out of Spaces
+	spacesUploadLogsEnvVar = "TURBO_SPACES_UPLOAD_LOGS"
+	// spacesTaskUpsertEnvVar opts into sending task summaries with PUT, so that re-sending a task replaces it
+	spacesTaskUpsertEnvVar = "TURBO_SPACES_TASK_UPSERT"
+	// spacesMirrorIDsEnvVar is a comma-separated list of Spaces to also record runs to
+	spacesMirrorIDsEnvVar = "TURBO_SPACES_MIRROR_IDS"
+	// spacesRunIDEnvVar adds the run's tasks to an existing run in the Space, instead of creating a new run
+	spacesRunIDEnvVar = "TURBO_SPACES_RUN_ID"
+	// spacesFinishRunEnvVar makes an invocation with spacesRunIDEnvVar mark the existing run as done, or cancelled if
+	// it's interrupted. Without it, only tasks are added, so that e.g. the first CI shard to finish doesn't end the run.
+	spacesFinishRunEnvVar = "TURBO_SPACES_FINISH_RUN"
+	// spacesAuditFileEnvVar is a file to write every request that was delivered to Spaces to,
+	// relative to the repo root unless it's absolute
+	spacesAuditFileEnvVar = "TURBO_SPACES_AUDIT_FILE"
+	// spacesStrictEnvVar makes Close fail when the run couldn't be fully recorded to Spaces
+	spacesStrictEnvVar = "TURBO_SPACES_STRICT"
+	// spacesDefaultBasePath is the path that the Spaces API endpoints are under
+	spacesDefaultBasePath = "/v0/spaces"
+	// spacesBasePathEnvVar overrides the path that the Spaces API endpoints are under, e.g. for a self-hosted API
+	spacesBasePathEnvVar = "TURBO_SPACES_BASE_PATH"
+	// spacesSendGraphEnvVar opts into sending the run's whole task graph, in addition to each task's dependencies
+	spacesSendGraphEnvVar = "TURBO_SPACES_SEND_GRAPH"
+	// spacesSendTaskStatsEnvVar opts into sending timings of the run's tasks, grouped by task name
+	spacesSendTaskStatsEnvVar = "TURBO_SPACES_SEND_TASK_STATS"
+	// spacesSendSummaryEnvVar opts into sending the whole run summary once the run's tasks have been sent
+	spacesSendSummaryEnvVar = "TURBO_SPACES_SEND_SUMMARY"
+	// spacesSkipCacheHitsEnvVar opts into only sending the tasks that weren't restored from the cache
+	spacesSkipCacheHitsEnvVar = "TURBO_SPACES_SKIP_CACHE_HITS"
+	// spacesMaxTasksEnvVar caps the number of task summaries sent per run. The run still counts every task.
+	spacesMaxTasksEnvVar = "TURBO_SPACES_MAX_TASKS"
+	// spacesMaxTasksStrategyEnvVar is how tasks are picked when there are more than spacesMaxTasksEnvVar:
+	// "slowest" (the default), "failed-first" or "first"
+	spacesMaxTasksStrategyEnvVar = "TURBO_SPACES_MAX_TASKS_STRATEGY"
+	// spacesBranchesEnvVar is a comma-separated list of branch globs, e.g. "main,release/*". When it's set,
+	// only runs on a matching branch are recorded to Spaces.
+	spacesBranchesEnvVar = "TURBO_SPACES_BRANCHES"
+	// spacesIgnoreBranchesEnvVar is a comma-separated list of branch globs that runs aren't recorded to Spaces for,
+	// even if they match spacesBranchesEnvVar
+	spacesIgnoreBranchesEnvVar = "TURBO_SPACES_IGNORE_BRANCHES"
+	// spacesLogBodiesEnvVar opts into including request bodies when requests are logged at debug level
+	spacesLogBodiesEnvVar = "TURBO_SPACES_LOG_BODIES"
+	// spacesProxyEnvVar sends requests to Spaces through the given proxy. Without it, requests go through
+	// the proxy from HTTPS_PROXY and NO_PROXY, like every other request to the API.
+	spacesProxyEnvVar = "TURBO_SPACES_PROXY"
+	// spacesCAFileEnvVar is a PEM file of CA certificates to trust for requests to Spaces, in addition
+	// to the system's, e.g. for a self-hosted Spaces API behind an internal CA
+	spacesCAFileEnvVar = "TURBO_SPACES_CA_FILE"
+	// spacesInsecureSkipVerifyEnvVar turns off TLS certificate verification for requests to Spaces.
+	// It's only meant for testing.
+	spacesInsecureSkipVerifyEnvVar = "TURBO_SPACES_INSECURE_SKIP_VERIFY"
+	// spacesLabelsEnvVar is a comma-separated list of labels to tag runs with, e.g. "nightly,pr-1234"
+	spacesLabelsEnvVar = "TURBO_SPACES_LABELS"
+	// spacesRunNameEnvVar gives the run a name to show in the Space in place of its command
+	spacesRunNameEnvVar = "TURBO_SPACES_RUN_NAME"
+	// spacesRunContextEnvVar overrides where the run is reported to have happened, e.g. "LOCAL" or "GITHUB_ACTIONS"
+	spacesRunContextEnvVar = "TURBO_RUN_CONTEXT"
+	// spacesDisableEnvVar turns off recording runs to Spaces without removing the space ID from config
+	spacesDisableEnvVar = "TURBO_DISABLE_SPACES"
+	// spacesDryRunResponse is returned in place of a response from the API for dry runs,
+	// so that the rest of the run can be recorded against a placeholder run ID.
+	spacesDryRunResponse = `{"id":"dry-run"}`
+)
+
+// spacesSchemaVersion is sent with every payload, so the Spaces API knows which shape of payload it's
+// receiving. It should be bumped whenever a field is removed or changes meaning.
+const spacesSchemaVersion = "1"
+
+// spacesNoExitCode is sent as the exit code of a task that never exited, e.g. because the run was interrupted
+const spacesNoExitCode = -1
+
+// Statuses for a Run in a Space
+const (
+	spacesRunStatusRunning   = "running"
+	spacesRunStatusCompleted = "completed"
+	spacesRunStatusCancelled = "cancelled"
+	// spacesRunStatusInterrupted is for a run that was stopped by a signal, and recorded by Flush
+	spacesRunStatusInterrupted = "interrupted"
 )
 
+// Results of a finished Run, for the Space to show without having to interpret the exit code
+const (
+	spacesRunResultSuccess   = "success"
+	spacesRunResultFailed    = "failed"
+	spacesRunResultCancelled = "cancelled"
+)
+
+// spacesAPIClient is the subset of client.APIClient that is needed to talk to Spaces.
+// Tests implement it to record runs without a network.
+type spacesAPIClient interface {
+	IsLinked() bool
+	JSONPostWithHeaders(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error)
+	JSONPatchWithHeaders(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error)
+	JSONPutWithHeaders(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error)
+}
+
+// spacesSendFunc sends a single request to the Spaces API
+type spacesSendFunc func(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error)
+
+// spacesEndpoints builds the paths of the Spaces API endpoints
+type spacesEndpoints struct {
+	basePath string
+}
+
+// newSpacesEndpoints returns endpoints under basePath, or under spacesDefaultBasePath if it's empty
+func newSpacesEndpoints(basePath string) spacesEndpoints {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath == "" {
+		return spacesEndpoints{basePath: spacesDefaultBasePath}
+	}
+	if !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return spacesEndpoints{basePath: basePath}
+}
+
+// runs is where runs are created
+func (e spacesEndpoints) runs(spaceID string) string {
+	return fmt.Sprintf("%s/%s/runs", e.basePath, spaceID)
+}
+
+// run is where a run is updated
+func (e spacesEndpoints) run(spaceID string, runID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s", e.basePath, spaceID, runID)
+}
+
+// tasks is where a run's task summaries are posted
+func (e spacesEndpoints) tasks(spaceID string, runID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s/tasks", e.basePath, spaceID, runID)
+}
+
+// tasksBatch is where a run's task summaries are posted in batches
+func (e spacesEndpoints) tasksBatch(spaceID string, runID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s/tasks/batch", e.basePath, spaceID, runID)
+}
+
+// graph is where a run's task graph is posted
+func (e spacesEndpoints) graph(spaceID string, runID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s/graph", e.basePath, spaceID, runID)
+}
+
+// summary is where the whole run summary is posted
+func (e spacesEndpoints) summary(spaceID string, runID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s/summary", e.basePath, spaceID, runID)
+}
+
+// taskStats is where timings of a run's tasks, grouped by task name, are posted
+func (e spacesEndpoints) taskStats(spaceID string, runID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s/task-stats", e.basePath, spaceID, runID)
+}
+
+// task is where a single task summary is put, keyed by its task ID
+func (e spacesEndpoints) task(spaceID string, runID string, taskID string) string {
+	return fmt.Sprintf("%s/%s/runs/%s/tasks/%s", e.basePath, spaceID, runID, url.PathEscape(taskID))
+}
+
+// spacesClient sends requests to the Spaces API, retrying transient failures
+type spacesClient struct {
+	api            spacesAPIClient
+	endpoints      spacesEndpoints
+	requestTimeout time.Duration
+	// abortTimeout bounds marking a run as cancelled once its context is done
+	abortTimeout time.Duration
+	// retry is how requests are retried, except for creating a run, which uses createRetry
+	retry       spacesRetryPolicy
+	createRetry spacesRetryPolicy
+	// concurrency is the number of workers sending task summaries
+	concurrency int
+	// inFlight caps the number of requests being sent at the same time, across workers and heartbeats
+	inFlight util.Semaphore
+	// taskBatchSize is the number of task summaries sent per request. 0 sends each task individually.
+	taskBatchSize int
+	// taskUpsert sends individual task summaries with PUT to an endpoint keyed by task ID, instead of POST
+	taskUpsert bool
+	// maxPayloadBytes is the size above which request bodies are rejected without being sent
+	maxPayloadBytes int
+	// compressThreshold is the size in bytes above which POST bodies are gzipped. 0 disables compression.
+	compressThreshold int
+	// compressionUnsupported is set once the server rejects a gzipped body. Must be used via atomic package.
+	compressionUnsupported int32
+
+	// tasksPosted counts the task summaries that were sent successfully to each Space
+	tasksPosted   map[string]int
+	tasksPostedMu sync.Mutex
+	// onTaskPosted, if set, is called with the running count each time a task summary is sent successfully.
+	// It is called from multiple goroutines.
+	onTaskPosted func(posted int, total int)
+
+	// startJitter is the most that creating a run is delayed by. 0 disables the delay.
+	startJitter time.Duration
+	// jitterRand picks the delay before creating a run
+	jitterRand *rand.Rand
+
+	// heartbeatInterval is how often the run is marked as still running while its tasks are sent. 0 disables heartbeats.
+	heartbeatInterval time.Duration
+	// clock is used for timing requests, backing off between retries and scheduling heartbeats
+	clock spacesClock
+
+	// headers are sent with every request
+	headers http.Header
+	// traceID is sent with every request in spacesTraceHeader
+	traceID string
+
+	stats spacesStats
+
+	// auditPath is where the requests delivered to Spaces are written when the run is closed.
+	// Empty disables the audit.
+	auditPath turbopath.AbsoluteSystemPath
+	audit     spacesAudit
+
+	// linked is whether the repo is linked, checked once when the client is created
+	linked bool
+	// disabled skips recording runs and replaying failed requests altogether
+	disabled bool
+	// dryRun prints requests to ui instead of sending them
+	dryRun bool
+	ui     cli.Ui
+
+	// logger gets a debug line for every request that is sent. Bodies are left out unless logBodies is set,
+	// since they can contain task logs.
+	logger    hclog.Logger
+	logBodies bool
+	// tracer starts a span for each request
+	tracer SpacesTracer
+
+	// failedRequestsPath is where requests that couldn't be delivered are saved for replay.
+	// Empty disables saving.
+	failedRequestsPath turbopath.AbsoluteSystemPath
+	failedRequestsMu   sync.Mutex
+
+	// errs are the errors from recording the run. They're kept on the client rather than on Meta,
+	// which is passed around by value.
+	errs   []error
+	errsMu sync.Mutex
+
+	// finalizing is set once Close or Flush starts recording the run, so that it's only recorded once.
+	// Must be used via atomic package. finalized is closed when that recording is done.
+	finalizing int32
+	finalized  chan struct{}
+}
+
+// isNotFoundError returns whether err is a 404 response from the API
+func isNotFoundError(err error) bool {
+	statusErr := &client.StatusError{}
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// setUserAgent identifies the version of turbo and the platform it ran on to Spaces,
+// in place of the User-Agent that the API client sends by default
+func (c *spacesClient) setUserAgent(turboVersion string) {
+	c.headers.Set("User-Agent", fmt.Sprintf("turbo/%v (%v/%v)", turboVersion, runtime.GOOS, runtime.GOARCH))
+}
+
+// getSpacesProxy returns the proxy from spacesProxyEnvVar, or nil if it isn't set
+func getSpacesProxy(envVars env.EnvironmentVariableMap) (*url.URL, error) {
+	proxy := envVars[spacesProxyEnvVar]
+	if proxy == "" {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid %v %q", spacesProxyEnvVar, proxy)
+	}
+	return proxyURL, nil
+}
+
+// getSpacesTLSConfig returns the TLS config from spacesCAFileEnvVar and spacesInsecureSkipVerifyEnvVar,
+// or nil if neither is set
+func getSpacesTLSConfig(envVars env.EnvironmentVariableMap) (*tls.Config, error) {
+	caFile := envVars[spacesCAFileEnvVar]
+	insecureSkipVerify, _ := strconv.ParseBool(envVars[spacesInsecureSkipVerifyEnvVar])
+	if caFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", spacesCAFileEnvVar, err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid %v: no certificates found in %v", spacesCAFileEnvVar, caFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig, nil
+}
+
+// newSpacesTransport returns the transport for requests to Spaces. The default transport only
+// keeps 2 idle connections per host, so with more workers than that most task summaries would
+// be sent on a new connection. Instead, a connection is kept open for every worker.
+// Requests go through proxyURL if it's set, and otherwise the proxy from the environment.
+// tlsConfig replaces the default TLS config if it's set.
+func newSpacesTransport(proxyURL *url.URL, tlsConfig *tls.Config, workers int) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = workers
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport
+}
+
+// useAPIClient sends requests with a copy of apiClient that goes through the proxy and TLS
+// settings from envVars, and leaves retrying requests to c. Invalid settings are warned about
+// on ui and ignored.
+func (c *spacesClient) useAPIClient(apiClient *client.APIClient, envVars env.EnvironmentVariableMap, ui cli.Ui) {
+	proxyURL, err := getSpacesProxy(envVars)
+	if err != nil {
+		ui.Warn(fmt.Sprintf("Ignoring Spaces proxy: %v", err))
+	}
+	tlsConfig, err := getSpacesTLSConfig(envVars)
+	if err != nil {
+		ui.Warn(fmt.Sprintf("Ignoring Spaces TLS settings: %v", err))
+	} else if tlsConfig != nil && tlsConfig.InsecureSkipVerify {
+		ui.Warn(fmt.Sprintf("%v is set, so TLS certificates aren't verified for requests to Spaces. Anyone on the network can read and change them. Only use this for testing.", spacesInsecureSkipVerifyEnvVar))
+	}
+	// The spaces client retries requests itself, and honors Retry-After, so the API client mustn't retry them too
+	c.api = apiClient.WithTransport(newSpacesTransport(proxyURL, tlsConfig, c.concurrency)).WithoutRetries()
+}
+
+// errors returns a copy of the errors from recording the run
+func (c *spacesClient) errors() []error {
+	c.errsMu.Lock()
+	defer c.errsMu.Unlock()
+	if len(c.errs) == 0 {
+		return nil
+	}
+	errs := make([]error, len(c.errs))
+	copy(errs, c.errs)
+	return errs
+}
+
+// setErrors replaces the errors from recording the run
+func (c *spacesClient) setErrors(errs []error) {
+	c.errsMu.Lock()
+	defer c.errsMu.Unlock()
+	c.errs = errs
+}
+
+// startFinalizing returns whether the caller is the first to finalize the run, and should record it.
+// The caller must call finishFinalizing when it's done.
+func (c *spacesClient) startFinalizing() bool {
+	return atomic.CompareAndSwapInt32(&c.finalizing, 0, 1)
+}
+
+func (c *spacesClient) finishFinalizing() {
+	close(c.finalized)
+}
+
+// getSpacesMirrorIDs returns the Spaces listed in spacesMirrorIDsEnvVar, in order and without
+// duplicates or the run's own Space
+func getSpacesMirrorIDs(envVars env.EnvironmentVariableMap, spaceID string) []string {
+	mirrors := []string{}
+	seen := util.SetFromStrings([]string{spaceID})
+	for _, mirror := range strings.Split(envVars[spacesMirrorIDsEnvVar], ",") {
+		mirror = strings.TrimSpace(mirror)
+		if mirror != "" && !seen.Includes(mirror) {
+			seen.Add(mirror)
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return mirrors
+}
+
+func newSpacesClient(api spacesAPIClient, envVars env.EnvironmentVariableMap) *spacesClient {
+	traceID := uuid.New().String()
+	c := &spacesClient{
+		api:               api,
+		linked:            api.IsLinked(),
+		endpoints:         newSpacesEndpoints(envVars[spacesBasePathEnvVar]),
+		retry:             spacesRetryPolicy{maxAttempts: spacesMaxAttempts, baseDelay: spacesRetryBaseDelay, requestDeadline: spacesRequestDeadline},
+		createRetry:       spacesRetryPolicy{maxAttempts: spacesCreateMaxAttempts, baseDelay: spacesCreateRetryBaseDelay, requestDeadline: spacesCreateRequestDeadline},
+		requestTimeout:    spacesRequestTimeout,
+		abortTimeout:      spacesAbortTimeout,
+		concurrency:       spacesConcurrency,
+		inFlight:          util.NewSemaphore(spacesMaxInFlight),
+		compressThreshold: spacesCompressThreshold,
+		maxPayloadBytes:   spacesMaxPayloadBytes,
+		clock:             realClock{},
+		jitterRand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		headers:           http.Header{spacesTraceHeader: []string{traceID}, "Accept-Encoding": []string{"gzip"}},
+		traceID:           traceID,
+		logger:            hclog.NewNullLogger(),
+		tracer:            noopSpacesTracer{},
+		finalized:         make(chan struct{}),
+	}
+
+	if disabled, err := strconv.ParseBool(envVars[spacesDisableEnvVar]); err == nil {
+		c.disabled = disabled
+	}
+	c.logBodies, _ = strconv.ParseBool(envVars[spacesLogBodiesEnvVar])
+
+	if concurrency, err := strconv.Atoi(envVars[spacesConcurrencyEnvVar]); err == nil {
+		switch {
+		case concurrency < 1:
+			c.concurrency = 1
+		case concurrency > spacesMaxConcurrency:
+			c.concurrency = spacesMaxConcurrency
+		default:
+			c.concurrency = concurrency
+		}
+	}
+
+	if maxAttempts, err := strconv.Atoi(envVars[spacesCreateMaxAttemptsEnvVar]); err == nil && maxAttempts > 0 {
+		c.createRetry.maxAttempts = maxAttempts
+	}
+
+	if maxInFlight, err := strconv.Atoi(envVars[spacesMaxInFlightEnvVar]); err == nil {
+		if maxInFlight < 1 {
+			maxInFlight = 1
+		}
+		c.inFlight = util.NewSemaphore(maxInFlight)
+	}
+
+	if maxPayloadBytes, err := strconv.Atoi(envVars[spacesMaxPayloadBytesEnvVar]); err == nil && maxPayloadBytes > 0 {
+		c.maxPayloadBytes = maxPayloadBytes
+	}
+
+	if batchSize, err := strconv.Atoi(envVars[spacesTaskBatchSizeEnvVar]); err == nil && batchSize > 0 {
+		c.taskBatchSize = batchSize
+	}
+
+	if upsert, err := strconv.ParseBool(envVars[spacesTaskUpsertEnvVar]); err == nil {
+		c.taskUpsert = upsert
+	}
+
+	if millis, err := strconv.Atoi(envVars[spacesStartJitterEnvVar]); err == nil && millis > 0 {
+		c.startJitter = time.Duration(millis) * time.Millisecond
+	}
+
+	if seconds, err := strconv.Atoi(envVars[spacesHeartbeatIntervalEnvVar]); err == nil && seconds > 0 {
+		c.heartbeatInterval = time.Duration(seconds) * time.Second
+	}
+
+	return c
+}
+
+// makeRequest sends the body to the url with the given method.
+// Bodies larger than maxPayloadBytes aren't sent at all.
+// Network errors, 429 and 5xx responses are retried with exponential backoff,
+// or after the time given by a 429's Retry-After header, until the retry policy's
+// maxAttempts is reached or the next attempt would exceed its requestDeadline.
+// Each attempt is cancelled after requestTimeout, and no new attempts are
+// started once ctx is cancelled. Requests that still fail with a retryable
+// error, and weren't cancelled with ctx, are saved to failedRequestsPath so
+// they can be replayed later.
+func (c *spacesClient) makeRequest(ctx context.Context, method string, url string, body []byte) ([]byte, error) {
+	return c.makeRequestWithOptions(ctx, method, url, body, spacesRequestOptions{})
+}
+
+// spacesRequestOptions changes how a single request is sent
+type spacesRequestOptions struct {
+	// headers are sent with every attempt at the request, in addition to the client's headers
+	headers http.Header
+	// retry replaces the client's retry policy for the request
+	retry *spacesRetryPolicy
+	// skipSave keeps the request out of failedRequestsPath if it fails
+	skipSave bool
+}
+
+// makeRequestWithOptions is makeRequest, with options for this request only
+func (c *spacesClient) makeRequestWithOptions(ctx context.Context, method string, url string, body []byte, opts spacesRequestOptions) ([]byte, error) {
+	ctx, span := c.tracer.Start(ctx, spacesRequestSpan)
+	defer span.End()
+	span.SetAttribute("http.method", method)
+	span.SetAttribute("http.url", url)
+	span.SetAttribute("http.request_content_length", len(body))
+
+	resp, err := c.sendRequest(ctx, method, url, body, opts)
+	if err != nil {
+		httpErr := &HTTPError{}
+		if errors.As(err, &httpErr) {
+			span.SetAttribute("http.status_code", httpErr.StatusCode)
+		}
+		span.RecordError(err)
+	}
+	return resp, err
+}
+
+// sendRequest implements makeRequestWithOptions
+func (c *spacesClient) sendRequest(ctx context.Context, method string, url string, body []byte, opts spacesRequestOptions) ([]byte, error) {
+	var send spacesSendFunc
+	switch method {
+	case http.MethodPost:
+		send = c.api.JSONPostWithHeaders
+	case http.MethodPatch:
+		send = c.api.JSONPatchWithHeaders
+	case http.MethodPut:
+		send = c.api.JSONPutWithHeaders
+	default:
+		return nil, fmt.Errorf("unsupported request method %v", method)
+	}
+
+	if len(body) > c.maxPayloadBytes {
+		return nil, fmt.Errorf("%w: %v bytes is over the limit of %v bytes", ErrPayloadTooLarge, len(body), c.maxPayloadBytes)
+	}
+
+	if c.dryRun {
+		c.printRequest(method, url, body)
+		return []byte(spacesDryRunResponse), nil
+	}
+
+	start := c.clock.Now()
+	retry := c.retry
+	if opts.retry != nil {
+		retry = *opts.retry
+	}
+	resp, err := c.sendWithRetries(ctx, c.limitInFlight(c.countBytes(send)), method, url, body, opts.headers, retry)
+	c.stats.recordRequest(c.clock.Now().Sub(start))
+	// Requests cancelled along with the run weren't failed by Spaces, and aren't worth sending later
+	if err != nil && isRetryableSpacesError(err) && !opts.skipSave && ctx.Err() == nil {
+		c.saveFailedRequest(&spacesFailedRequest{Method: method, URL: url, Headers: opts.headers, Body: body})
+	}
+	if err == nil && c.auditPath != "" {
+		c.audit.recordSent(method, url, body)
+	}
+
+	if err == nil {
+		resp, err = decodeResponse(resp)
+	}
+
+	statusErr := &client.StatusError{}
+	if errors.As(err, &statusErr) {
+		// Error responses are gzipped the same as successful ones, and their body is shown to the user.
+		// The error is copied rather than changed, since it isn't necessarily ours to change.
+		if decoded, decodeErr := decodeResponse([]byte(statusErr.Body)); decodeErr == nil && string(decoded) != statusErr.Body {
+			err = &client.StatusError{StatusCode: statusErr.StatusCode, Body: string(decoded), Header: statusErr.Header}
+		}
+		return nil, &HTTPError{StatusCode: statusErr.StatusCode, Method: method, Endpoint: url, Err: err}
+	}
+	return resp, err
+}
+
+// sendWithRetries implements the retry and compression behavior of makeRequest
+func (c *spacesClient) sendWithRetries(ctx context.Context, send spacesSendFunc, method string, url string, body []byte, requestHeaders http.Header, retry spacesRetryPolicy) ([]byte, error) {
+	requestBody, encodingHeaders := c.encodeBody(method, body)
+	headers := c.withHeaders(requestHeaders, encodingHeaders)
+	sendOnce := func() ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+
+		resp, err := send(ctx, url, requestBody, headers)
+		statusErr := &client.StatusError{}
+		if encodingHeaders != nil && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnsupportedMediaType {
+			// The server doesn't accept compressed bodies, send this and all future requests as-is
+			atomic.StoreInt32(&c.compressionUnsupported, 1)
+			requestBody, encodingHeaders, headers = body, nil, c.withHeaders(requestHeaders)
+			return send(ctx, url, requestBody, headers)
+		}
+		return resp, err
+	}
+
+	deadline := c.clock.Now().Add(retry.requestDeadline)
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		start := c.clock.Now()
+		resp, err := sendOnce()
+		c.logRequest(method, url, body, attempt, c.clock.Now().Sub(start), err)
+		if err == nil || attempt >= retry.maxAttempts || !isRetryableSpacesError(err) {
+			return resp, err
+		}
+
+		delay := retry.delay(attempt)
+		if retryAfter, ok := c.retryAfter(err); ok {
+			delay = retryAfter
+		}
+		if c.clock.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.clock.After(delay):
+		}
+	}
+}
+
+// logRequest writes a debug line for one attempt at sending a request
+func (c *spacesClient) logRequest(method string, url string, body []byte, attempt int, duration time.Duration, err error) {
+	if !c.logger.IsDebug() {
+		return
+	}
+
+	args := []interface{}{"method", method, "url", url, "attempt", attempt, "duration", duration}
+	statusErr := &client.StatusError{}
+	switch {
+	case errors.As(err, &statusErr):
+		args = append(args, "status", statusErr.StatusCode)
+	case err != nil:
+		args = append(args, "error", err)
+	default:
+		args = append(args, "status", "ok")
+	}
+	if c.logBodies {
+		args = append(args, "body", string(body))
+	} else {
+		args = append(args, "body", fmt.Sprintf("<%v bytes redacted>", len(body)))
+	}
+	c.logger.Debug("spaces request", args...)
+}
+
+// encodeBody gzips POST and PUT bodies larger than compressThreshold and returns the headers
+// needed to send the encoded body.
+func (c *spacesClient) encodeBody(method string, body []byte) ([]byte, http.Header) {
+	if (method != http.MethodPost && method != http.MethodPut) || c.compressThreshold <= 0 || len(body) <= c.compressThreshold {
+		return body, nil
+	}
+	if atomic.LoadInt32(&c.compressionUnsupported) == 1 {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return body, nil
+	}
+	if err := writer.Close(); err != nil {
+		return body, nil
+	}
+
+	return buf.Bytes(), http.Header{"Content-Encoding": []string{"gzip"}}
+}
+
+// decodeResponse decompresses gzipped response bodies, including those of error responses.
+// Since every request asks for gzip, the HTTP transport leaves decompressing the response to us.
+func decodeResponse(resp []byte) ([]byte, error) {
+	if !bytes.HasPrefix(resp, []byte{0x1f, 0x8b}) {
+		return resp, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(resp))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress response: %w", err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress response: %w", err)
+	}
+	return decompressed, nil
+}
+
+// printRequest writes the request that would have been sent to ui, with the body pretty-printed
+func (c *spacesClient) printRequest(method string, url string, body []byte) {
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil {
+		pretty.Reset()
+		pretty.Write(body)
+	}
+	c.ui.Output(fmt.Sprintf("%s %s\n%s", method, url, pretty.String()))
+}
+
+// waitToStart waits a random duration of up to startJitter, or until ctx is done
+func (c *spacesClient) waitToStart(ctx context.Context) error {
+	if c.startJitter <= 0 || c.dryRun {
+		return nil
+	}
+
+	delay := time.Duration(c.jitterRand.Int63n(int64(c.startJitter) + 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.clock.After(delay):
+		return nil
+	}
+}
+
+// startHeartbeat marks the run at patchURL as still running every heartbeatInterval,
+// until ctx is done or the returned stop function is called. stop waits for any
+// heartbeat in flight to finish.
+func (c *spacesClient) startHeartbeat(ctx context.Context, patchURL string) func() {
+	if c.heartbeatInterval <= 0 || c.dryRun {
+		return func() {}
+	}
+
+	ticks, stopTicker := c.clock.NewTicker(c.heartbeatInterval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer stopTicker()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-ticks:
+				c.sendHeartbeat(ctx, patchURL, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// sendHeartbeat makes a single attempt to mark the run as still running. Failures are
+// ignored, and not saved for replay, since the next heartbeat supersedes this one.
+func (c *spacesClient) sendHeartbeat(ctx context.Context, patchURL string, now time.Time) {
+	payload, err := json.Marshal(newSpacesHeartbeatPayload(now))
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	defer cancel()
+	_, _ = c.limitInFlight(c.api.JSONPatchWithHeaders)(ctx, patchURL, payload, c.withHeaders(nil))
+}
+
+// spacesClock is the source of time for the Spaces client, so that tests can control it
+type spacesClock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a channel that ticks every interval and a function to stop it
+	NewTicker(interval time.Duration) (<-chan time.Time, func())
+}
+
+// realClock is a spacesClock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// countBytes wraps send to record the size of each body that is sent
+func (c *spacesClient) countBytes(send spacesSendFunc) spacesSendFunc {
+	return func(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error) {
+		c.stats.recordBytes(len(body))
+		return send(ctx, endpoint, body, headers)
+	}
+}
+
+// limitInFlight wraps send to wait for a slot in inFlight before sending, and to release it once
+// the response is received. Waiting stops when ctx is done.
+func (c *spacesClient) limitInFlight(send spacesSendFunc) spacesSendFunc {
+	return func(ctx context.Context, endpoint string, body []byte, headers http.Header) ([]byte, error) {
+		select {
+		case c.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer c.inFlight.Release()
+		return send(ctx, endpoint, body, headers)
+	}
+}
+
+// withHeaders returns the headers set on the client combined with the given headers.
+// Later headers replace earlier ones with the same key.
+func (c *spacesClient) withHeaders(headers ...http.Header) http.Header {
+	combined := c.headers.Clone()
+	if combined == nil {
+		combined = http.Header{}
+	}
+	for _, extra := range headers {
+		for key, values := range extra {
+			combined[key] = values
+		}
+	}
+	return combined
+}
+
+// taskPosted records that a task summary out of total was sent successfully to spaceID
+func (c *spacesClient) taskPosted(spaceID string, total int) {
+	c.tasksPostedMu.Lock()
+	if c.tasksPosted == nil {
+		c.tasksPosted = map[string]int{}
+	}
+	c.tasksPosted[spaceID]++
+	posted := c.tasksPosted[spaceID]
+	c.tasksPostedMu.Unlock()
+
+	if c.onTaskPosted != nil {
+		c.onTaskPosted(posted, total)
+	}
+}
+
+// postedTasks returns the number of task summaries that were sent successfully to spaceID
+func (c *spacesClient) postedTasks(spaceID string) int {
+	c.tasksPostedMu.Lock()
+	defer c.tasksPostedMu.Unlock()
+	return c.tasksPosted[spaceID]
+}
+
+// spacesRetryPolicy is how many times, and for how long, a request is retried
+type spacesRetryPolicy struct {
+	maxAttempts int
+	// baseDelay is the backoff before the first retry. It doubles for each subsequent retry.
+	baseDelay time.Duration
+	// requestDeadline bounds the total time spent on the request, including retries
+	requestDeadline time.Duration
+}
+
+// delay returns the exponential backoff for the given attempt, with up to 50% jitter added
+func (p spacesRetryPolicy) delay(attempt int) time.Duration {
+	delay := p.baseDelay << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// retryAfter returns how long the Retry-After header of a 429 response asks to wait, capped at
+// spacesMaxRetryAfter. The header can be given either in seconds or as an HTTP date.
+func (c *spacesClient) retryAfter(err error) (time.Duration, bool) {
+	statusErr := &client.StatusError{}
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	value := statusErr.Header.Get("Retry-After")
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(c.clock.Now())
+	} else {
+		return 0, false
+	}
+
+	switch {
+	case delay < 0:
+		return 0, true
+	case delay > spacesMaxRetryAfter:
+		return spacesMaxRetryAfter, true
+	default:
+		return delay, true
+	}
+}
+
+// isRetryableSpacesError returns true for network errors, 429 and 5xx responses
+func isRetryableSpacesError(err error) bool {
+	if errors.Is(err, client.ErrTooManyFailures) || errors.Is(err, ErrPayloadTooLarge) {
+		return false
+	}
+
+	statusErr := &client.StatusError{}
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	return true
+}
+
 // spacesRunResponse deserialized the response from POST Run endpoint
 type spacesRunResponse struct {
 	ID  string
@@ -17,18 +968,39 @@ type spacesClientSummary struct {
 }
 
 type spacesRunPayload struct {
-	StartTime      int64               `json:"startTime,omitempty"`      // when the run was started
-	EndTime        int64               `json:"endTime,omitempty"`        // when the run ended. we should never submit start and end at the same time.
-	Status         string              `json:"status,omitempty"`         // Status is "running" or "completed"
-	Type           string              `json:"type,omitempty"`           // hardcoded to "TURBO"
-	ExitCode       int                 `json:"exitCode,omitempty"`       // exit code for the full run
-	Command        string              `json:"command,omitempty"`        // the thing that kicked off the turbo run
-	RepositoryPath string              `json:"repositoryPath,omitempty"` // where the command was invoked from
-	Context        string              `json:"context,omitempty"`        // the host on which this Run was executed (e.g. Github Action, Vercel, etc)
-	Client         spacesClientSummary `json:"client"`                   // Details about the turbo client
-	GitBranch      string              `json:"gitBranch"`
-	GitSha         string              `json:"gitSha"`
-	User           string              `json:"originationUser,omitempty"`
+	SchemaVersion    string              `json:"schemaVersion"`            // set to spacesSchemaVersion when the payload is marshaled
+	StartTime        int64               `json:"startTime,omitempty"`      // when the run was started
+	EndTime          int64               `json:"endTime,omitempty"`        // when the run ended. we should never submit start and end at the same time.
+	Status           string              `json:"status,omitempty"`         // Status is "running", "completed" or "cancelled"
+	Type             string              `json:"type,omitempty"`           // hardcoded to "TURBO"
+	ExitCode         int                 `json:"exitCode,omitempty"`       // exit code for the full run
+	Result           string              `json:"result,omitempty"`         // Result is "success", "failed" or "cancelled" once the run is done
+	Command          string              `json:"command,omitempty"`        // the thing that kicked off the turbo run
+	Name             string              `json:"name,omitempty"`           // what the run is called in the Space, the command unless it was named
+	RepositoryPath   string              `json:"repositoryPath,omitempty"` // where the command was invoked from
+	Context          string              `json:"context,omitempty"`        // the host on which this Run was executed (e.g. Github Action, Vercel, etc)
+	Platform         string              `json:"platform,omitempty"`       // the OS and architecture turbo ran on, e.g. "linux/amd64"
+	CIJobURL         string              `json:"ciJobUrl,omitempty"`       // link to the CI job the run is part of
+	PackageManager   string              `json:"packageManager,omitempty"` // e.g. "npm", "yarn" or "pnpm"
+	WorkspaceCount   int                 `json:"workspaceCount,omitempty"` // number of workspaces in the repo, not including the root
+	Labels           []string            `json:"labels,omitempty"`         // for filtering runs in the Space, e.g. "nightly"
+	DaemonEnabled    *bool               `json:"daemonEnabled,omitempty"`  // whether the run could use the turbo daemon, only sent when creating the run
+	Client           spacesClientSummary `json:"client"`                   // Details about the turbo client
+	GitBranch        string              `json:"gitBranch"`
+	GitSha           string              `json:"gitSha"`
+	GitCommitAuthor  string              `json:"gitCommitAuthor,omitempty"`
+	GitCommitMessage string              `json:"gitCommitMessage,omitempty"` // the subject line of the commit
+	GitRefType       string              `json:"gitRefType,omitempty"`       // "branch", "tag" or "detached"
+	GitTag           string              `json:"gitTag,omitempty"`           // the tag that was checked out, for tag runs
+	User             string              `json:"originationUser,omitempty"`
+	TotalTasks       int                 `json:"totalTasks,omitempty"`     // number of tasks in the run
+	CachedTasks      int                 `json:"cachedTasks,omitempty"`    // number of tasks that had a cache hit
+	ExecutedTasks    int                 `json:"executedTasks,omitempty"`  // number of tasks that ran and exited successfully (does not include cache hits)
+	FailedTasks      int                 `json:"failedTasks,omitempty"`    // number of tasks that ran and exited with failure
+	TotalTimeSaved   int                 `json:"totalTimeSaved,omitempty"` // milliseconds saved by cache hits, summed across tasks
+	SkippedTasks     int                 `json:"skippedTasks,omitempty"`   // number of tasks that are counted, but weren't sent
+	HasFailures      bool                `json:"hasFailures,omitempty"`    // whether any task exited with a non-zero exit code, even if the run didn't
+	UpdatedTime      int64               `json:"updatedTime,omitempty"`    // when the run was last known to be running
 }
 
 // spacesCacheStatus is the same as TaskCacheSummary so we can convert
@@ -43,36 +1015,104 @@ type spacesCacheStatus struct {
 }
 
 type spacesTask struct {
-	Key          string            `json:"key,omitempty"`
-	Name         string            `json:"name,omitempty"`
-	Workspace    string            `json:"workspace,omitempty"`
-	Hash         string            `json:"hash,omitempty"`
-	StartTime    int64             `json:"startTime,omitempty"`
-	EndTime      int64             `json:"endTime,omitempty"`
-	Cache        spacesCacheStatus `json:"cache,omitempty"`
-	ExitCode     int               `json:"exitCode,omitempty"`
-	Dependencies []string          `json:"dependencies,omitempty"`
-	Dependents   []string          `json:"dependents,omitempty"`
-	Logs         string            `json:"log"`
+	SchemaVersion string            `json:"schemaVersion"` // set to spacesSchemaVersion when the payload is marshaled
+	Key           string            `json:"key,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	Workspace     string            `json:"workspace,omitempty"`
+	WorkspacePath string            `json:"workspacePath,omitempty"` // relative to the repo root, with forward slashes. "." for the root workspace
+	Hash          string            `json:"hash,omitempty"`
+	StartTime     int64             `json:"startTime,omitempty"`
+	EndTime       int64             `json:"endTime,omitempty"`
+	QueuedTime    int64             `json:"queuedTime"` // milliseconds between the start of the run and the start of the task
+	Cache         spacesCacheStatus `json:"cache,omitempty"`
+	ExitCode      int               `json:"exitCode,omitempty"`
+	Attempts      int               `json:"attempts,omitempty"` // number of times the task started building
+	Dependencies  []string          `json:"dependencies,omitempty"`
+	Dependents    []string          `json:"dependents,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"` // metadata about the task, for filtering tasks in the Space
+	Logs          string            `json:"log"`
+	LogsAvailable bool              `json:"logsAvailable"`        // false if the task's logs couldn't be read or weren't uploaded, as opposed to being empty
+	HashInputs    *spacesHashInputs `json:"hashInputs,omitempty"` // only sent in verbose mode
+	EnvVarKeys    []string          `json:"envVarKeys,omitempty"` // names of the env vars that went into the hash, sorted. Only sent in verbose mode
+}
+
+// spacesGraph is the task graph of a run, so the Space can show it without piecing it together from tasks
+type spacesGraph struct {
+	SchemaVersion string            `json:"schemaVersion"`
+	Nodes         []string          `json:"nodes"` // task IDs, sorted
+	Edges         []spacesGraphEdge `json:"edges"` // sorted by task, then dependency
+}
+
+// spacesGraphEdge is a dependency of one task on another
+type spacesGraphEdge struct {
+	Task      string `json:"task"`
+	DependsOn string `json:"dependsOn"`
+}
+
+// newSpacesGraphPayload builds the task graph from the dependencies of each task. Dependencies that
+// didn't run, e.g. because their workspace doesn't have the script, are still included as nodes,
+// so that the graph stays connected.
+func (rsm *Meta) newSpacesGraphPayload() *spacesGraph {
+	nodes := make(util.Set)
+	edges := []spacesGraphEdge{}
+	for _, task := range rsm.RunSummary.Tasks {
+		nodes.Add(task.TaskID)
+		for _, dependency := range task.Dependencies {
+			nodes.Add(dependency)
+			edges = append(edges, spacesGraphEdge{Task: task.TaskID, DependsOn: dependency})
+		}
+	}
+
+	sortedNodes := nodes.UnsafeListOfStrings()
+	sort.Strings(sortedNodes)
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Task != edges[j].Task {
+			return edges[i].Task < edges[j].Task
+		}
+		return edges[i].DependsOn < edges[j].DependsOn
+	})
+	return &spacesGraph{Nodes: sortedNodes, Edges: edges}
+}
+
+// spacesHashInputs are the parts of a TaskSummary that go into the task's hash
+type spacesHashInputs struct {
+	Inputs                 map[turbopath.AnchoredUnixPath]string `json:"inputs"`
+	ExternalDepsHash       string                                `json:"hashOfExternalDependencies"`
+	Command                string                                `json:"command"`
+	CommandArguments       []string                              `json:"cliArguments"`
+	Outputs                []string                              `json:"outputs"`
+	ExcludedOutputs        []string                              `json:"excludedOutputs"`
+	Framework              string                                `json:"framework"`
+	EnvMode                util.EnvMode                          `json:"envMode"`
+	EnvVars                TaskEnvVarSummary                     `json:"environmentVariables"`
+	ResolvedTaskDefinition *fs.TaskDefinition                    `json:"resolvedTaskDefinition"`
 }
 
 func (rsm *Meta) newSpacesRunCreatePayload() *spacesRunPayload {
 	startTime := rsm.RunSummary.ExecutionSummary.startedAt.UnixMilli()
-	context := "LOCAL"
-	if name := ci.Constant(); name != "" {
-		context = name
-	}
+	daemonEnabled := rsm.daemonEnabled
 
 	return &spacesRunPayload{
-		StartTime:      startTime,
-		Status:         "running",
-		Command:        rsm.synthesizedCommand,
-		RepositoryPath: rsm.repoPath.ToString(),
-		Type:           "TURBO",
-		Context:        context,
-		GitBranch:      rsm.RunSummary.SCM.Branch,
-		GitSha:         rsm.RunSummary.SCM.Sha,
-		User:           rsm.RunSummary.User,
+		StartTime:        startTime,
+		Status:           spacesRunStatusRunning,
+		Command:          rsm.synthesizedCommand,
+		Name:             rsm.spacesRunName(),
+		RepositoryPath:   rsm.repoPath.ToString(),
+		Type:             "TURBO",
+		Context:          rsm.runContext,
+		Platform:         runtime.GOOS + "/" + runtime.GOARCH,
+		CIJobURL:         rsm.ciJobURL,
+		PackageManager:   rsm.packageManager,
+		WorkspaceCount:   rsm.workspaceCount,
+		Labels:           rsm.labels,
+		DaemonEnabled:    &daemonEnabled,
+		GitBranch:        rsm.RunSummary.SCM.Branch,
+		GitSha:           rsm.RunSummary.SCM.Sha,
+		GitCommitAuthor:  rsm.RunSummary.SCM.commitAuthor,
+		GitCommitMessage: rsm.RunSummary.SCM.commitMessage,
+		GitRefType:       rsm.RunSummary.SCM.refType,
+		GitTag:           rsm.RunSummary.SCM.tag,
+		User:             rsm.RunSummary.User,
 		Client: spacesClientSummary{
 			ID:      "turbo",
 			Name:    "Turbo",
@@ -81,30 +1121,384 @@ func (rsm *Meta) newSpacesRunCreatePayload() *spacesRunPayload {
 	}
 }
 
-func newSpacesDonePayload(runsummary *RunSummary) *spacesRunPayload {
-	endTime := runsummary.ExecutionSummary.endedAt.UnixMilli()
+// validateCreate checks that a payload for creating a run has the fields the Spaces API requires.
+// A run summary that wasn't set up properly would otherwise be sent, and rejected with a less helpful error.
+func (p *spacesRunPayload) validateCreate() error {
+	missing := []string{}
+	if p.StartTime <= 0 {
+		missing = append(missing, "startTime")
+	}
+	if p.Command == "" {
+		missing = append(missing, "command")
+	}
+	if p.Client.Version == "" {
+		missing = append(missing, "client.version")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing %v", ErrInvalidRunPayload, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// newSpacesDonePayload returns the payload that finishes the run. Runs recorded by Flush
+// are marked as interrupted, rather than completed.
+func (rsm *Meta) newSpacesDonePayload() *spacesRunPayload {
+	runsummary := rsm.RunSummary
+	startTime := runsummary.ExecutionSummary.startedAt.UnixMilli()
+	endTime := rsm.clampEndTime(startTime, runsummary.ExecutionSummary.endedAt.UnixMilli(), "run")
+	timeSaved := 0
+	hasFailures := false
+	for _, task := range runsummary.Tasks {
+		if task.CacheSummary.Status == cache.CacheEventHit {
+			timeSaved += task.CacheSummary.TimeSaved
+		}
+		// Checked from the tasks themselves, rather than inferred from the run's exit code
+		if task.Execution != nil {
+			if exitCode := task.Execution.ExitCode(); exitCode != nil && *exitCode != 0 {
+				hasFailures = true
+			}
+		}
+	}
+
+	payload := &spacesRunPayload{
+		Status:         spacesRunStatusCompleted,
+		EndTime:        endTime,
+		ExitCode:       runsummary.ExecutionSummary.exitCode,
+		Result:         spacesRunResult(runsummary.ExecutionSummary.exitCode),
+		TotalTasks:     len(runsummary.Tasks),
+		CachedTasks:    runsummary.ExecutionSummary.cached,
+		ExecutedTasks:  runsummary.ExecutionSummary.success,
+		FailedTasks:    runsummary.ExecutionSummary.failure,
+		TotalTimeSaved: timeSaved,
+		SkippedTasks:   rsm.skippedTaskCount(),
+		HasFailures:    hasFailures,
+	}
+	if rsm.interrupted {
+		payload.Status = spacesRunStatusInterrupted
+		payload.Result = spacesRunResultCancelled
+	}
+	return payload
+}
+
+// clampEndTime returns endTime, or startTime if endTime is before it. Durations are measured
+// with the monotonic clock, but payloads have wall clock times, so adjusting the clock during
+// the run can make something end before it started. The warning is logged for the given name.
+func (rsm *Meta) clampEndTime(startTime int64, endTime int64, name string) int64 {
+	if endTime >= startTime {
+		return endTime
+	}
+	rsm.spacesClient.logger.Warn("end time is before start time, sending the start time instead", "name", name, "startTime", startTime, "endTime", endTime)
+	return startTime
+}
+
+// spacesRunResult maps the exit code of a run that wasn't interrupted to its result
+func spacesRunResult(exitCode int) string {
+	if exitCode == 0 {
+		return spacesRunResultSuccess
+	}
+	return spacesRunResultFailed
+}
+
+func newSpacesHeartbeatPayload(now time.Time) *spacesRunPayload {
+	// Heartbeats are sent by the client on its own, so they don't go through marshalSpacesPayload
 	return &spacesRunPayload{
-		Status:   "completed",
-		EndTime:  endTime,
-		ExitCode: runsummary.ExecutionSummary.exitCode,
+		SchemaVersion: spacesSchemaVersion,
+		Status:        spacesRunStatusRunning,
+		UpdatedTime:   now.UnixMilli(),
 	}
 }
 
-func newSpacesTaskPayload(taskSummary *TaskSummary) *spacesTask {
+func (rsm *Meta) newSpacesCancelledPayload() *spacesRunPayload {
+	payload := rsm.newSpacesDonePayload()
+	payload.Status = spacesRunStatusCancelled
+	payload.Result = spacesRunResultCancelled
+	return payload
+}
+
+func (rsm *Meta) newSpacesTaskPayload(taskSummary *TaskSummary) *spacesTask {
 	startTime := taskSummary.Execution.startAt.UnixMilli()
-	endTime := taskSummary.Execution.endTime().UnixMilli()
+	endTime := rsm.clampEndTime(startTime, taskSummary.Execution.endTime().UnixMilli(), taskSummary.TaskID)
+	// Clamp to zero in case the clock moved backwards between the run and the task starting
+	queuedTime := taskSummary.Execution.startAt.Sub(rsm.RunSummary.ExecutionSummary.startedAt).Milliseconds()
+	if queuedTime < 0 {
+		queuedTime = 0
+	}
+
+	var hashInputs *spacesHashInputs
+	var envVarKeys []string
+	if rsm.sendHashInputs {
+		envVarKeys = spacesEnvVarKeys(taskSummary.EnvVars)
+		hashInputs = &spacesHashInputs{
+			Inputs:                 taskSummary.ExpandedInputs,
+			ExternalDepsHash:       taskSummary.ExternalDepsHash,
+			Command:                taskSummary.Command,
+			CommandArguments:       taskSummary.CommandArguments,
+			Outputs:                taskSummary.Outputs,
+			ExcludedOutputs:        taskSummary.ExcludedOutputs,
+			Framework:              taskSummary.Framework,
+			EnvMode:                taskSummary.EnvMode,
+			EnvVars:                taskSummary.EnvVars,
+			ResolvedTaskDefinition: taskSummary.ResolvedTaskDefinition,
+		}
+	}
+
+	// Tasks that were stopped before they exited don't have an exit code
+	exitCode := spacesNoExitCode
+	if code := taskSummary.Execution.ExitCode(); code != nil {
+		exitCode = *code
+	}
+
+	// Logs aren't read at all when they won't be uploaded
+	var logs []byte
+	var logsAvailable bool
+	if rsm.uploadLogs {
+		logs, logsAvailable = taskSummary.readLogs()
+	}
 
 	return &spacesTask{
-		Key:          taskSummary.TaskID,
-		Name:         taskSummary.Task,
-		Workspace:    taskSummary.Package,
-		Hash:         taskSummary.Hash,
-		StartTime:    startTime,
-		EndTime:      endTime,
-		Cache:        spacesCacheStatus(taskSummary.CacheSummary), // wrapped so we can remove fields
-		ExitCode:     *taskSummary.Execution.exitCode,
-		Dependencies: taskSummary.Dependencies,
-		Dependents:   taskSummary.Dependents,
-		Logs:         string(taskSummary.GetLogs()),
+		Key:           taskSummary.TaskID,
+		Name:          taskSummary.Task,
+		Workspace:     taskSummary.Package,
+		WorkspacePath: spacesWorkspacePath(taskSummary.Dir),
+		Hash:          taskSummary.Hash,
+		StartTime:     startTime,
+		EndTime:       endTime,
+		QueuedTime:    queuedTime,
+		Cache:         spacesCacheStatus(taskSummary.CacheSummary), // wrapped so we can remove fields
+		ExitCode:      exitCode,
+		Attempts:      taskSummary.Execution.attempts,
+		Dependencies:  sortedCopy(taskSummary.Dependencies),
+		Dependents:    sortedCopy(taskSummary.Dependents),
+		Tags:          spacesTaskTags(taskSummary),
+		Logs:          string(truncateLogs(rsm.logRedactor.redact(filterLogLines(logs, rsm.logLineFilter)), rsm.maxLogBytes)),
+		LogsAvailable: logsAvailable,
+		HashInputs:    hashInputs,
+		EnvVarKeys:    envVarKeys,
+	}
+}
+
+// spacesTaskTags returns what is known about a task beyond its hash inputs, such as the framework
+// that was detected for its workspace. Unlike the hash inputs, tags are sent without verbose mode.
+func spacesTaskTags(taskSummary *TaskSummary) map[string]string {
+	tags := map[string]string{}
+	if taskSummary.Framework != "" {
+		tags["framework"] = taskSummary.Framework
+	}
+	if taskSummary.ResolvedTaskDefinition != nil && taskSummary.ResolvedTaskDefinition.Persistent {
+		tags["persistent"] = "true"
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// sortedCopy returns the strings sorted, without changing the order of the original slice
+func sortedCopy(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// spacesEnvVarKeys returns the names of the env vars that went into a task's hash, without their values.
+// Passthrough env vars are left out, since they're available to the task without being hashed.
+func spacesEnvVarKeys(envVars TaskEnvVarSummary) []string {
+	keys := make(util.Set)
+	for _, list := range [][]string{envVars.Configured, envVars.Inferred, envVars.Global} {
+		for _, envVar := range list {
+			key, _, _ := strings.Cut(envVar, "=")
+			keys.Add(key)
+		}
+	}
+	sorted := keys.UnsafeListOfStrings()
+	sort.Strings(sorted)
+	return sorted
+}
+
+// spacesWorkspacePath converts a workspace directory to the path shown in a Space
+func spacesWorkspacePath(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return filepath.ToSlash(dir)
+}
+
+// ErrNotLinked is returned when a run can't be sent to a Space because the repo isn't linked
+var ErrNotLinked = errors.New("repo is not linked to a Space")
+
+// ErrNoSpaceID is returned when a run is sent to a Space without a Space ID
+var ErrNoSpaceID = errors.New("no Space ID was provided")
+
+// ErrInvalidSpaceID is returned when a run is sent to a Space with a malformed Space ID
+var ErrInvalidSpaceID = errors.New("invalid Space ID")
+
+// ErrSpacesUploadFailed is returned by Close in strict mode when the run couldn't be fully recorded to Spaces
+var ErrSpacesUploadFailed = errors.New("run could not be recorded to Spaces")
+
+// ErrPayloadTooLarge is returned when a request body is too large to send to Spaces
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrInvalidRunID is returned when tasks are added to an existing run with a malformed run ID
+var ErrInvalidRunID = errors.New("invalid run ID")
+
+// ErrInvalidRunPayload is returned when a run can't be created in a Space, because it's missing required fields or can't be marshaled
+var ErrInvalidRunPayload = errors.New("invalid run")
+
+// ErrInvalidLabel is returned for a run label that the Spaces API wouldn't accept
+var ErrInvalidLabel = errors.New("invalid label")
+
+// ErrInvalidTaskLimit is returned when the cap on the number of task summaries sent to Spaces is malformed
+var ErrInvalidTaskLimit = errors.New("invalid task limit")
+
+// ErrInvalidBranchPattern is returned for a branch glob that can't be matched against
+var ErrInvalidBranchPattern = errors.New("invalid branch pattern")
+
+// ErrCloseTimeout is returned by CloseWithTimeout when the run is still being recorded at the deadline
+var ErrCloseTimeout = errors.New("timed out recording run")
+
+// ErrRecordingAbandoned is reported when the context for recording a run is done before the run has been recorded
+var ErrRecordingAbandoned = errors.New("stopped waiting for the run to be recorded")
+
+// ErrTasksUnsupported is returned when a Space responds to task summaries with a 404, e.g. because
+// the API predates the tasks endpoint. The run itself is still recorded.
+var ErrTasksUnsupported = errors.New("the Spaces API doesn't support recording tasks, so only the run itself was recorded")
+
+// ErrInvalidRunSummary is returned by LoadAndSend for a file that isn't a run summary that can be recorded
+var ErrInvalidRunSummary = errors.New("invalid run summary")
+
+// spacesLabelPattern matches a label for a run
+var spacesLabelPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// getSpacesLabels returns the labels listed in spacesLabelsEnvVar, in order and without duplicates.
+// Invalid labels are left out, and returned as errors.
+func getSpacesLabels(envVars env.EnvironmentVariableMap) ([]string, []error) {
+	labels := []string{}
+	errs := []error{}
+	seen := make(util.Set)
+	for _, label := range strings.Split(envVars[spacesLabelsEnvVar], ",") {
+		label = strings.TrimSpace(label)
+		if label == "" || seen.Includes(label) {
+			continue
+		}
+		if !spacesLabelPattern.MatchString(label) {
+			errs = append(errs, fmt.Errorf("%w %q: labels can be up to 64 letters, numbers, dots, colons, underscores and dashes", ErrInvalidLabel, label))
+			continue
+		}
+		seen.Add(label)
+		labels = append(labels, label)
+	}
+	return labels, errs
+}
+
+// spaceIDPattern matches a Space ID. IDs are used as a segment of the API path, so they
+// can only contain letters, digits, underscores and dashes.
+var spaceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// validateSpaceID checks that spaceID has the shape the Spaces API expects
+func validateSpaceID(spaceID string) error {
+	if spaceID == "" {
+		return ErrNoSpaceID
+	}
+	if !spaceIDPattern.MatchString(spaceID) {
+		return fmt.Errorf("%w %q: Space IDs can only contain letters, numbers, underscores and dashes", ErrInvalidSpaceID, spaceID)
+	}
+	return nil
+}
+
+// HTTPError is returned when the Spaces API responds to a request with an error status.
+// The message is the error from the API.
+type HTTPError struct {
+	StatusCode int
+	Method     string
+	Endpoint   string
+	Err        error
+}
+
+// Error returns the error from the API
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error from the API
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// spacesTaskError is returned when a single task summary fails to reach Spaces
+type spacesTaskError struct {
+	taskID string
+	err    error
+}
+
+func (e *spacesTaskError) Error() string {
+	return fmt.Sprintf("Error sending %s summary to space: %v", e.taskID, e.err)
+}
+
+func (e *spacesTaskError) Unwrap() error {
+	return e.err
+}
+
+// spacesTargetError is an error from recording the run to a mirror Space
+type spacesTargetError struct {
+	spaceID string
+	err     error
+}
+
+func (e *spacesTargetError) Error() string {
+	return fmt.Sprintf("space %s: %v", e.spaceID, e.err)
+}
+
+func (e *spacesTargetError) Unwrap() error {
+	return e.err
+}
+
+// printSpacesErrors writes a deduplicated summary of errors from recording a run.
+// Errors for the run itself mean nothing useful made it to the Space, so they are
+// listed individually. Task errors are collapsed into a single count. The trace ID
+// is included so that it can be quoted when reporting the problem.
+func printSpacesErrors(terminal cli.Ui, errs []error, taskCount int, traceID string) {
+	if len(errs) == 0 {
+		return
+	}
+
+	var runErrs []string
+	var taskErrs []string
+	taskErrCounts := make(map[string]int)
+	for _, err := range errs {
+		taskErr := &spacesTaskError{}
+		if !errors.As(err, &taskErr) {
+			runErrs = append(runErrs, err.Error())
+			continue
+		}
+
+		message := taskErr.err.Error()
+		targetErr := &spacesTargetError{}
+		if errors.As(err, &targetErr) {
+			message = fmt.Sprintf("space %s: %v", targetErr.spaceID, message)
+		}
+		if taskErrCounts[message] == 0 {
+			taskErrs = append(taskErrs, message)
+		}
+		taskErrCounts[message]++
+	}
+
+	terminal.Warn("Errors recording run to Spaces")
+	for _, message := range runErrs {
+		terminal.Warn(fmt.Sprintf("Failed to record run: %v", message))
+	}
+
+	if failedTasks := len(errs) - len(runErrs); failedTasks > 0 {
+		terminal.Warn(fmt.Sprintf("%v of %v task updates failed to reach Spaces", failedTasks, taskCount))
+		for _, message := range taskErrs {
+			if count := taskErrCounts[message]; count > 1 {
+				message = fmt.Sprintf("%v (%v tasks)", message, count)
+			}
+			terminal.Warn(fmt.Sprintf("  %v", message))
+		}
 	}
+	terminal.Warn(fmt.Sprintf("Trace ID: %v", traceID))
 }
@@ -0,0 +1,48 @@
+package runsummary
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// spacesSentRequest is a request that was delivered to Spaces
+type spacesSentRequest struct {
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// spacesAudit keeps every request that was delivered to Spaces, so that they can be
+// written out and compared with what the Space shows
+type spacesAudit struct {
+	mu   sync.Mutex
+	sent []spacesSentRequest
+}
+
+// recordSent adds a delivered request to the audit
+func (a *spacesAudit) recordSent(method string, url string, body []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sent = append(a.sent, spacesSentRequest{Method: method, URL: url, Body: body})
+}
+
+// write saves the delivered requests to path as a JSON array, in the order they were delivered
+func (a *spacesAudit) write(path turbopath.AbsoluteSystemPath) error {
+	a.mu.Lock()
+	sent := a.sent
+	if sent == nil {
+		sent = []spacesSentRequest{}
+	}
+	contents, err := json.MarshalIndent(sent, "", "  ")
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := path.EnsureDir(); err != nil {
+		return err
+	}
+	return path.WriteFile(contents, 0644)
+}
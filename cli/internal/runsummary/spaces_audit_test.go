@@ -0,0 +1,59 @@
+package runsummary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestSendToSpace_audit(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.concurrency = 1
+	rsm.spacesClient.auditPath = turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("audit", "spaces.json")
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+
+	contents, err := rsm.spacesClient.auditPath.ReadFile()
+	assert.NilError(t, err)
+	var sent []spacesSentRequest
+	assert.NilError(t, json.Unmarshal(contents, &sent))
+
+	assert.Equal(t, len(sent), 5)
+	assert.Equal(t, len(sent), len(api.requests))
+	for i, request := range api.requests {
+		assert.Equal(t, sent[i].Method, request.method)
+		assert.Equal(t, sent[i].URL, request.url)
+		var body bytes.Buffer
+		assert.NilError(t, json.Compact(&body, sent[i].Body))
+		assert.Equal(t, body.String(), string(request.body))
+	}
+	assert.Equal(t, sent[0].URL, "/v0/spaces/space-id/runs")
+	assert.Equal(t, sent[4].Method, http.MethodPatch)
+}
+
+func TestSendToSpace_auditSkipsFailedRequests(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 0)
+	rsm.spacesClient.auditPath = turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("spaces.json")
+	rsm.spaceID = "not a space id"
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+
+	contents, err := rsm.spacesClient.auditPath.ReadFile()
+	assert.NilError(t, err)
+	assert.Equal(t, string(contents), "[]")
+}
+
+func TestSendToSpace_noAudit(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 1)
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+	assert.Equal(t, len(rsm.spacesClient.audit.sent), 0)
+}
@@ -0,0 +1,63 @@
+package runsummary
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vercel/turbo/cli/internal/doublestar"
+	"github.com/vercel/turbo/cli/internal/env"
+)
+
+// spacesBranchFilter decides which branches runs are recorded to Spaces for
+type spacesBranchFilter struct {
+	// include are the globs that a branch has to match one of. Empty allows every branch.
+	include []string
+	// exclude are the globs that a branch can't match any of, whether or not it's included
+	exclude []string
+}
+
+// getSpacesBranchFilter returns the filter set by spacesBranchesEnvVar and spacesIgnoreBranchesEnvVar.
+// Invalid globs are left out, and returned as errors.
+func getSpacesBranchFilter(envVars env.EnvironmentVariableMap) (spacesBranchFilter, []error) {
+	include, includeErrs := getSpacesBranchPatterns(envVars[spacesBranchesEnvVar])
+	exclude, excludeErrs := getSpacesBranchPatterns(envVars[spacesIgnoreBranchesEnvVar])
+	return spacesBranchFilter{include: include, exclude: exclude}, append(includeErrs, excludeErrs...)
+}
+
+// getSpacesBranchPatterns splits a comma-separated list of branch globs. Since the list is split on
+// commas, globs can't use {a,b} alternatives.
+func getSpacesBranchPatterns(list string) ([]string, []error) {
+	patterns := []string{}
+	errs := []error{}
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !doublestar.ValidatePattern(pattern) {
+			errs = append(errs, fmt.Errorf("%w %q", ErrInvalidBranchPattern, pattern))
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, errs
+}
+
+// allows returns whether runs on branch are recorded to Spaces. A "*" doesn't match
+// across a "/", so "release/*" matches "release/1.0" and "release/**" also matches "release/1.0/fix".
+func (f spacesBranchFilter) allows(branch string) bool {
+	if len(f.include) > 0 && !matchesBranchPattern(f.include, branch) {
+		return false
+	}
+	return !matchesBranchPattern(f.exclude, branch)
+}
+
+// matchesBranchPattern returns whether branch matches any of patterns, which have already been validated
+func matchesBranchPattern(patterns []string, branch string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := doublestar.Match(pattern, branch); matched {
+			return true
+		}
+	}
+	return false
+}
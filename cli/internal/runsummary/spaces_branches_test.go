@@ -0,0 +1,74 @@
+package runsummary
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vercel/turbo/cli/internal/env"
+	"gotest.tools/v3/assert"
+)
+
+func TestSpacesBranchFilter_allows(t *testing.T) {
+	testCases := []struct {
+		name    string
+		envVars env.EnvironmentVariableMap
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "no filter",
+			envVars: env.EnvironmentVariableMap{},
+			allowed: []string{"main", "feature/login", ""},
+		},
+		{
+			name:    "include",
+			envVars: env.EnvironmentVariableMap{spacesBranchesEnvVar: "main, release/*"},
+			allowed: []string{"main", "release/1.0"},
+			denied:  []string{"feature/login", "release/1.0/hotfix", "main-backup", ""},
+		},
+		{
+			name:    "include nested",
+			envVars: env.EnvironmentVariableMap{spacesBranchesEnvVar: "release/**"},
+			allowed: []string{"release/1.0", "release/1.0/hotfix"},
+			denied:  []string{"main"},
+		},
+		{
+			name:    "exclude",
+			envVars: env.EnvironmentVariableMap{spacesIgnoreBranchesEnvVar: "dependabot/**,renovate/*"},
+			allowed: []string{"main", "feature/login"},
+			denied:  []string{"dependabot/npm/react-18", "renovate/react"},
+		},
+		{
+			name:    "exclude wins over include",
+			envVars: env.EnvironmentVariableMap{spacesBranchesEnvVar: "release/*", spacesIgnoreBranchesEnvVar: "release/*-rc"},
+			allowed: []string{"release/1.0"},
+			denied:  []string{"release/1.0-rc", "main"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, errs := getSpacesBranchFilter(tc.envVars)
+			assert.Equal(t, len(errs), 0)
+			for _, branch := range tc.allowed {
+				assert.Assert(t, filter.allows(branch), "branch %q should be allowed", branch)
+			}
+			for _, branch := range tc.denied {
+				assert.Assert(t, !filter.allows(branch), "branch %q should be denied", branch)
+			}
+		})
+	}
+}
+
+func TestGetSpacesBranchFilter_invalidPatterns(t *testing.T) {
+	filter, errs := getSpacesBranchFilter(env.EnvironmentVariableMap{
+		spacesBranchesEnvVar:       "main,release/[,,",
+		spacesIgnoreBranchesEnvVar: "wip/[",
+	})
+	assert.DeepEqual(t, filter.include, []string{"main"})
+	assert.Equal(t, len(filter.exclude), 0)
+	assert.Equal(t, len(errs), 2)
+	for _, err := range errs {
+		assert.Assert(t, errors.Is(err, ErrInvalidBranchPattern))
+	}
+}
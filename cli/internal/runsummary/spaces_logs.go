@@ -0,0 +1,105 @@
+package runsummary
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/vercel/turbo/cli/internal/env"
+)
+
+// redactedLogValue replaces secrets found in task logs sent to Spaces
+const redactedLogValue = "[REDACTED]"
+
+// _defaultMaxLogBytes is the size above which task logs are truncated before they are sent to Spaces
+const _defaultMaxLogBytes = 1024 * 1024
+
+// _minRedactedValueLength avoids masking short, common values like "1" or "true"
+// just because they happen to be set on a secret-looking environment variable.
+const _minRedactedValueLength = 6
+
+// secretEnvVarName matches the names of environment variables whose values are likely secrets
+var secretEnvVarName = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|API_?KEY|PRIVATE_?KEY|CREDENTIAL)`)
+
+// logRedactor masks secrets in task logs before they are sent to Spaces
+type logRedactor struct {
+	patterns []*regexp.Regexp
+	values   []string
+}
+
+// newLogRedactor creates a logRedactor that masks the values of any secret-looking
+// environment variables.
+func newLogRedactor(envVars env.EnvironmentVariableMap) *logRedactor {
+	r := &logRedactor{}
+	for name, value := range envVars {
+		if len(value) >= _minRedactedValueLength && secretEnvVarName.MatchString(name) {
+			r.values = append(r.values, value)
+		}
+	}
+
+	// Replace longer values first, in case one secret contains another
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+
+	return r
+}
+
+// redact replaces known secret values and matches of the redaction patterns in logs
+func (r *logRedactor) redact(logs []byte) []byte {
+	for _, value := range r.values {
+		logs = bytes.ReplaceAll(logs, []byte(value), []byte(redactedLogValue))
+	}
+	for _, pattern := range r.patterns {
+		logs = pattern.ReplaceAllLiteral(logs, []byte(redactedLogValue))
+	}
+	return logs
+}
+
+// filterLogLines returns the lines of logs for which keep returns true. keep is given each line
+// without its line ending. A nil keep returns logs as they are.
+func filterLogLines(logs []byte, keep func(line []byte) bool) []byte {
+	if keep == nil {
+		return logs
+	}
+
+	filtered := make([]byte, 0, len(logs))
+	for len(logs) > 0 {
+		line := logs
+		if i := bytes.IndexByte(logs, '\n'); i >= 0 {
+			line = logs[:i+1]
+		}
+		logs = logs[len(line):]
+		if keep(bytes.TrimRight(line, "\r\n")) {
+			filtered = append(filtered, line...)
+		}
+	}
+	return filtered
+}
+
+// truncateLogs keeps the first and last maxBytes/2 bytes of logs that are larger
+// than maxBytes, replacing the middle with a marker noting how much was dropped.
+func truncateLogs(logs []byte, maxBytes int) []byte {
+	if maxBytes <= 0 || len(logs) <= maxBytes {
+		return logs
+	}
+
+	// Don't split a multi-byte character in half
+	headEnd := maxBytes / 2
+	for headEnd > 0 && !utf8.RuneStart(logs[headEnd]) {
+		headEnd--
+	}
+	tailStart := len(logs) - (maxBytes - maxBytes/2)
+	for tailStart < len(logs) && !utf8.RuneStart(logs[tailStart]) {
+		tailStart++
+	}
+
+	marker := fmt.Sprintf("\n... [truncated %v bytes] ...\n", tailStart-headEnd)
+	truncated := make([]byte, 0, headEnd+len(marker)+len(logs)-tailStart)
+	truncated = append(truncated, logs[:headEnd]...)
+	truncated = append(truncated, marker...)
+	truncated = append(truncated, logs[tailStart:]...)
+	return truncated
+}
@@ -0,0 +1,201 @@
+package runsummary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/cli"
+	"github.com/vercel/turbo/cli/internal/ci"
+	"github.com/vercel/turbo/cli/internal/client"
+	"github.com/vercel/turbo/cli/internal/env"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+)
+
+// _maxFailedRequestsBytes caps the size of the failed requests file. Once it's reached, requests
+// that fail are dropped rather than saved, so a long outage doesn't fill the disk with task logs.
+const _maxFailedRequestsBytes = 32 * 1024 * 1024
+
+// spacesFailedRequest is a request to Spaces that couldn't be delivered.
+// Each one is saved as a line of JSON in the failed requests file.
+type spacesFailedRequest struct {
+	Method  string          `json:"method"`
+	URL     string          `json:"url"`
+	Headers http.Header     `json:"headers,omitempty"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// getSpacesFailedRequestsPath returns the file that undelivered requests to Spaces are saved to
+func getSpacesFailedRequestsPath(repoRoot turbopath.AbsoluteSystemPath) turbopath.AbsoluteSystemPath {
+	return repoRoot.UntypedJoin(".turbo", "spaces", "failed-requests.jsonl")
+}
+
+// saveFailedRequest appends a request to failedRequestsPath, unless the file is already at
+// _maxFailedRequestsBytes. Saving is best effort, so a failure to write is ignored, the same
+// as a failure to send would have been.
+func (c *spacesClient) saveFailedRequest(request *spacesFailedRequest) {
+	if c.failedRequestsPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	c.failedRequestsMu.Lock()
+	defer c.failedRequestsMu.Unlock()
+
+	if info, err := c.failedRequestsPath.Stat(); err == nil && info.Size()+int64(len(line)) > _maxFailedRequestsBytes {
+		return
+	}
+	if err := c.failedRequestsPath.EnsureDir(); err != nil {
+		return
+	}
+	f, err := c.failedRequestsPath.OpenFile(os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+	_, _ = f.Write(append(line, '\n'))
+}
+
+// replayFailedRequests sends every request in failedRequestsPath, in the order they were saved.
+// Requests that fail again are saved back for the next replay, and once ctx is done, the requests
+// that are left are saved back without being sent. It returns the number of requests that were
+// replayed and any errors from sending them. Runs recorded to a Space call it before creating their run.
+func (c *spacesClient) replayFailedRequests(ctx context.Context) (int, []error) {
+	if c.disabled || c.failedRequestsPath == "" {
+		return 0, nil
+	}
+	if !c.linked {
+		return 0, []error{ErrNotLinked}
+	}
+
+	contents, err := c.failedRequestsPath.ReadFile()
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, []error{err}
+	}
+
+	// Requests that fail during the replay are appended to a fresh file
+	if err := c.failedRequestsPath.Remove(); err != nil {
+		return 0, []error{err}
+	}
+
+	replayed := 0
+	errs := []error{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	for {
+		request := &spacesFailedRequest{}
+		if err := decoder.Decode(request); err == io.EOF {
+			break
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("reading %v: %w", c.failedRequestsPath, err))
+			break
+		}
+
+		if ctx.Err() != nil {
+			c.saveFailedRequest(request)
+			continue
+		}
+		replayed++
+		opts := spacesRequestOptions{headers: request.Headers}
+		if _, err := c.makeRequestWithOptions(ctx, request.Method, request.URL, request.Body, opts); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", request.Method, request.URL, err))
+			// Requests cancelled partway aren't saved by makeRequest, but shouldn't be lost either
+			if ctx.Err() != nil {
+				c.saveFailedRequest(request)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return replayed, errs
+	}
+	return replayed, nil
+}
+
+// LoadAndSend records a run summary that was saved with --summarize to spaceID, as if the run
+// had just finished. It's for backfilling runs that couldn't be recorded at the time, e.g. during
+// an outage. Task logs are only sent if the log files are still where the run left them.
+//
+// Requests go through the Spaces proxy and TLS settings, and runs on branches that the branch
+// filter leaves out aren't sent, the same as for a run that just finished. Requests that fail
+// aren't saved for replay, and no audit file is written, since those are kept in the repo.
+func LoadAndSend(ctx context.Context, path turbopath.AbsoluteSystemPath, spaceID string, apiClient *client.APIClient, ui cli.Ui) error {
+	envVars := env.GetEnvMap()
+	c := newSpacesClient(apiClient, envVars)
+	c.ui = ui
+	c.useAPIClient(apiClient, envVars, ui)
+	rsm, err := loadRunSummary(path, spaceID, c, envVars)
+	if err != nil {
+		return err
+	}
+	return SendRunSummary(ctx, rsm)
+}
+
+// loadRunSummary reads a saved run summary into a Meta that records it to spaceID with c.
+// Settings that aren't part of the summary, like labels, are taken from envVars.
+func loadRunSummary(path turbopath.AbsoluteSystemPath, spaceID string, c *spacesClient, envVars env.EnvironmentVariableMap) (*Meta, error) {
+	contents, err := path.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	summary := &RunSummary{}
+	if err := json.Unmarshal(contents, summary); err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrInvalidRunSummary, path, err)
+	}
+	// Dry runs are saved without an execution summary, and have nothing to record
+	if summary.ExecutionSummary == nil {
+		return nil, fmt.Errorf("%w %v: it has no execution, so it may be from a dry run", ErrInvalidRunSummary, path)
+	}
+	for i, task := range summary.Tasks {
+		if task == nil || task.Execution == nil {
+			return nil, fmt.Errorf("%w %v: task %v has no execution", ErrInvalidRunSummary, path, i)
+		}
+	}
+	if summary.SCM == nil {
+		summary.SCM = &scmState{}
+	}
+
+	c.setUserAgent(summary.TurboVersion)
+	sendHashInputs, _ := strconv.ParseBool(envVars[spacesVerboseEnvVar])
+	labels, _ := getSpacesLabels(envVars)
+	branchFilter, branchErrs := getSpacesBranchFilter(envVars)
+	for _, err := range branchErrs {
+		c.ui.Warn(fmt.Sprintf("Ignoring Spaces branch pattern: %v", err))
+	}
+	if !branchFilter.allows(summary.SCM.Branch) {
+		c.disabled = true
+		c.ui.Warn(fmt.Sprintf("Not sending the run on branch %q, since %v or %v leave it out of Spaces", summary.SCM.Branch, spacesBranchesEnvVar, spacesIgnoreBranchesEnvVar))
+	}
+	uploadLogs := true
+	if upload, err := strconv.ParseBool(envVars[spacesUploadLogsEnvVar]); err == nil {
+		uploadLogs = upload
+	}
+	return &Meta{
+		RunSummary:         summary,
+		ui:                 c.ui,
+		runType:            runTypeReal,
+		spacesClient:       c,
+		logRedactor:        newLogRedactor(envVars),
+		maxLogBytes:        _defaultMaxLogBytes,
+		sendHashInputs:     sendHashInputs,
+		uploadLogs:         uploadLogs,
+		spaceID:            spaceID,
+		repoPath:           summary.ExecutionSummary.repoPath,
+		runName:            strings.TrimSpace(envVars[spacesRunNameEnvVar]),
+		runContext:         getRunContext(envVars, ci.Info()),
+		labels:             labels,
+		synthesizedCommand: summary.ExecutionSummary.command,
+	}, nil
+}
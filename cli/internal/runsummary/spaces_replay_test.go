@@ -0,0 +1,302 @@
+package runsummary
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/cli"
+	"github.com/vercel/turbo/cli/internal/client"
+	"github.com/vercel/turbo/cli/internal/env"
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"gotest.tools/v3/assert"
+)
+
+func TestSpacesClient_replayFailedRequests(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	// Every attempt fails with a network error, so both requests are saved
+	down := &fakeSpacesAPI{failures: 100, err: errors.New("connection refused")}
+	c := newTestSpacesClient(down)
+	c.failedRequestsPath = path
+
+	_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", []byte(`{"key":"my-app#build"}`))
+	assert.ErrorContains(t, err, "connection refused")
+	_, err = c.makeRequest(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/run-id", []byte(`{"status":"completed"}`))
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Assert(t, path.FileExists())
+
+	up := &fakeSpacesAPI{}
+	c = newTestSpacesClient(up)
+	c.failedRequestsPath = path
+
+	replayed, errs := c.replayFailedRequests(context.Background())
+	assert.Equal(t, replayed, 2)
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, up.requestCount(), 2)
+	assert.Equal(t, up.requests[0].method, http.MethodPost)
+	assert.Equal(t, up.requests[0].url, "/v0/spaces/space-id/runs/run-id/tasks")
+	assert.Equal(t, string(up.requests[0].body), `{"key":"my-app#build"}`)
+	assert.Equal(t, up.requests[1].method, http.MethodPatch)
+	assert.Equal(t, up.requests[1].url, "/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, string(up.requests[1].body), `{"status":"completed"}`)
+
+	// Nothing is left to replay
+	assert.Assert(t, !path.FileExists())
+	replayed, errs = c.replayFailedRequests(context.Background())
+	assert.Equal(t, replayed, 0)
+	assert.Equal(t, len(errs), 0)
+}
+
+func TestSpacesClient_replayFailedRequestsFailsAgain(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	down := &fakeSpacesAPI{failures: 100, err: &client.StatusError{StatusCode: http.StatusServiceUnavailable}}
+	c := newTestSpacesClient(down)
+	c.failedRequestsPath = path
+
+	_, _ = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{}`))
+	replayed, errs := c.replayFailedRequests(context.Background())
+	assert.Equal(t, replayed, 1)
+	assert.Equal(t, len(errs), 1)
+
+	// The request is saved again for the next replay
+	contents, err := path.ReadFile()
+	assert.NilError(t, err)
+	assert.Equal(t, string(contents), `{"method":"POST","url":"/v0/spaces/space-id/runs","body":{}}`+"\n")
+}
+
+func TestSpacesClient_clientErrorsAreNotSaved(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	api := &fakeSpacesAPI{failures: 1, err: &client.StatusError{StatusCode: http.StatusBadRequest}}
+	c := newTestSpacesClient(api)
+	c.failedRequestsPath = path
+
+	_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{}`))
+	assert.Assert(t, err != nil)
+	assert.Assert(t, !path.FileExists())
+}
+
+func TestSpacesClient_cancelledRequestsAreNotSaved(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	api := &fakeSpacesAPI{delay: time.Second}
+	c := newTestSpacesClient(api)
+	c.failedRequestsPath = path
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.makeRequest(ctx, http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", []byte(`{}`))
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Assert(t, !path.FileExists())
+}
+
+func TestSpacesClient_failedRequestsAreCapped(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+	assert.NilError(t, path.EnsureDir())
+	full := make([]byte, _maxFailedRequestsBytes-10)
+	assert.NilError(t, path.WriteFile(full, 0644))
+
+	api := &fakeSpacesAPI{failures: 100, err: errors.New("connection refused")}
+	c := newTestSpacesClient(api)
+	c.failedRequestsPath = path
+
+	_, _ = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", []byte(`{}`))
+	info, err := path.Stat()
+	assert.NilError(t, err)
+	assert.Equal(t, info.Size(), int64(len(full)))
+}
+
+func TestRecord_failedCreateIsNotSaved(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 100, err: errors.New("connection refused")}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.failedRequestsPath = getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	// Replaying the create alone would leave a run that's never finished
+	assert.Assert(t, !rsm.spacesClient.failedRequestsPath.FileExists())
+}
+
+func TestSendToSpace_replaysFailedRequests(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+	down := &fakeSpacesAPI{failures: 100, err: errors.New("connection refused")}
+	c := newTestSpacesClient(down)
+	c.failedRequestsPath = path
+	headers := http.Header{"X-Test": []string{"saved"}}
+	_, _ = c.makeRequestWithOptions(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/old-run", []byte(`{"status":"completed"}`), spacesRequestOptions{headers: headers})
+	assert.Assert(t, path.FileExists())
+
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 1)
+	rsm.spacesClient.failedRequestsPath = path
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+
+	// The saved request is sent, with its headers, before the new run is created
+	assert.Equal(t, api.requests[0].url, "/v0/spaces/space-id/runs/old-run")
+	assert.Equal(t, api.requests[0].headers.Get("X-Test"), "saved")
+	assert.Equal(t, api.requests[1].url, "/v0/spaces/space-id/runs")
+	assert.Assert(t, !path.FileExists())
+}
+
+func TestSpacesClient_replayFailedRequestsDisabled(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	down := &fakeSpacesAPI{failures: 100, err: errors.New("connection refused")}
+	c := newTestSpacesClient(down)
+	c.failedRequestsPath = path
+	_, _ = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{}`))
+
+	up := &fakeSpacesAPI{}
+	c = newSpacesClient(up, env.EnvironmentVariableMap{spacesDisableEnvVar: "true"})
+	c.failedRequestsPath = path
+
+	replayed, errs := c.replayFailedRequests(context.Background())
+	assert.Equal(t, replayed, 0)
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, up.requestCount(), 0)
+	// The requests are kept for when Spaces is enabled again
+	assert.Assert(t, path.FileExists())
+}
+
+func TestSpacesClient_replayFailedRequestsNotLinked(t *testing.T) {
+	path := getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	down := &fakeSpacesAPI{failures: 100, err: errors.New("connection refused")}
+	c := newTestSpacesClient(down)
+	c.failedRequestsPath = path
+	_, _ = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{}`))
+
+	unlinked := &fakeSpacesAPI{unlinked: true}
+	c = newTestSpacesClient(unlinked)
+	c.failedRequestsPath = path
+
+	replayed, errs := c.replayFailedRequests(context.Background())
+	assert.Equal(t, replayed, 0)
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrNotLinked))
+	assert.Equal(t, unlinked.requestCount(), 0)
+	assert.Assert(t, path.FileExists())
+}
+
+func TestLoadRunSummary_roundTrip(t *testing.T) {
+	sent := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(sent, 3)
+	startedAt := time.UnixMilli(1700000000000)
+	rsm.RunSummary.GlobalHashSummary = &GlobalHashSummary{}
+	rsm.RunSummary.SCM = &scmState{Type: "git", Branch: "main", Sha: "abc123"}
+	rsm.RunSummary.ExecutionSummary = &executionSummary{
+		command:   "turbo run build",
+		repoPath:  turbopath.RelativeSystemPathFromUpstream("apps/web"),
+		success:   2,
+		failure:   1,
+		attempted: 3,
+		startedAt: startedAt,
+		endedAt:   startedAt.Add(5 * time.Second),
+		exitCode:  1,
+	}
+	exitCode := 1
+	for i, task := range rsm.RunSummary.Tasks {
+		task.Task = "build"
+		task.Package = "my-app"
+		task.Dependencies = []string{"my-lib#build"}
+		task.ResolvedTaskDefinition = &fs.TaskDefinition{Outputs: fs.TaskOutputs{Inclusions: []string{"dist/**"}}, ShouldCache: true}
+		task.Execution.startAt = startedAt.Add(time.Duration(i) * time.Second)
+	}
+	rsm.RunSummary.Tasks[2].Execution.exitCode = &exitCode
+
+	summary, err := rsm.FormatJSON()
+	assert.NilError(t, err)
+	path := turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("summary.json")
+	assert.NilError(t, path.WriteFile(summary, 0644))
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	replayed := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	c := newTestSpacesClient(replayed)
+	c.ui = cli.NewMockUi()
+	loaded, err := loadRunSummary(path, "space-id", c, env.EnvironmentVariableMap{})
+	assert.NilError(t, err)
+	assert.Equal(t, loaded.RunSummary.Tasks[0].ResolvedTaskDefinition.Outputs.Inclusions[0], "dist/**")
+	assert.NilError(t, SendRunSummary(context.Background(), loaded))
+
+	// every task is sent the same as it was when the run finished
+	tasks := func(api *fakeSpacesAPI) map[string]string {
+		bodies := map[string]string{}
+		for _, request := range api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks") {
+			task := &spacesTask{}
+			assert.NilError(t, json.Unmarshal(request.body, task))
+			bodies[task.Key] = string(request.body)
+		}
+		return bodies
+	}
+	assert.Equal(t, len(tasks(replayed)), 3)
+	assert.DeepEqual(t, tasks(replayed), tasks(sent))
+
+	created := replayed.requestsTo("/v0/spaces/space-id/runs")
+	assert.Equal(t, len(created), 1)
+	run := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(created[0].body, run))
+	assert.Equal(t, run.Command, "turbo run build")
+	assert.Equal(t, run.RepositoryPath, filepath.FromSlash("apps/web"))
+	assert.Equal(t, run.StartTime, startedAt.UnixMilli())
+	assert.Equal(t, run.GitBranch, "main")
+	assert.Equal(t, run.GitSha, "abc123")
+	assert.Equal(t, run.Client.Version, "1.0.0")
+
+	done := replayed.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(done), 1)
+	finished := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(done[0].body, finished))
+	assert.Equal(t, finished.EndTime, startedAt.Add(5*time.Second).UnixMilli())
+	assert.Equal(t, finished.ExitCode, 1)
+	assert.Equal(t, finished.TotalTasks, 3)
+	assert.Equal(t, finished.FailedTasks, 1)
+}
+
+func TestLoadRunSummary_dryRun(t *testing.T) {
+	path := turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("summary.json")
+	assert.NilError(t, path.WriteFile([]byte(`{"id":"2PqmsXKFMmrfAHBVrD4QoFQHJiH","tasks":[]}`), 0644))
+
+	_, err := loadRunSummary(path, "space-id", newTestSpacesClient(&fakeSpacesAPI{}), env.EnvironmentVariableMap{})
+	assert.Assert(t, errors.Is(err, ErrInvalidRunSummary), err)
+
+	// A task without its execution, e.g. from a summary that was edited by hand
+	assert.NilError(t, path.WriteFile([]byte(`{"id":"2PqmsXKFMmrfAHBVrD4QoFQHJiH","execution":{},"tasks":[{"taskId":"my-app#build"}]}`), 0644))
+	_, err = loadRunSummary(path, "space-id", newTestSpacesClient(&fakeSpacesAPI{}), env.EnvironmentVariableMap{})
+	assert.Assert(t, errors.Is(err, ErrInvalidRunSummary), err)
+
+	assert.NilError(t, path.WriteFile([]byte(`not json`), 0644))
+	_, err = loadRunSummary(path, "space-id", newTestSpacesClient(&fakeSpacesAPI{}), env.EnvironmentVariableMap{})
+	assert.Assert(t, errors.Is(err, ErrInvalidRunSummary), err)
+}
+
+func TestLoadRunSummary_branchFilter(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 2)
+	rsm.RunSummary.GlobalHashSummary = &GlobalHashSummary{}
+	rsm.RunSummary.SCM = &scmState{Type: "git", Branch: "feature/login", Sha: "abc123"}
+	rsm.RunSummary.ExecutionSummary = &executionSummary{command: "turbo run build", success: 2, attempted: 2, startedAt: time.Now()}
+	summary, err := rsm.FormatJSON()
+	assert.NilError(t, err)
+	path := turbopath.AbsoluteSystemPath(t.TempDir()).UntypedJoin("summary.json")
+	assert.NilError(t, path.WriteFile(summary, 0644))
+
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	c := newTestSpacesClient(api)
+	ui := cli.NewMockUi()
+	c.ui = ui
+	loaded, err := loadRunSummary(path, "space-id", c, env.EnvironmentVariableMap{spacesBranchesEnvVar: "main"})
+	assert.NilError(t, err)
+	assert.NilError(t, SendRunSummary(context.Background(), loaded))
+
+	// runs on other branches are left out of Spaces, the same as when they finish
+	assert.Equal(t, api.requestCount(), 0)
+	assert.Assert(t, strings.Contains(ui.ErrorWriter.String(), `Not sending the run on branch "feature/login"`), ui.ErrorWriter.String())
+}
@@ -0,0 +1,237 @@
+package runsummary
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/vercel/turbo/cli/internal/client"
+	"github.com/vercel/turbo/cli/internal/turbostate"
+	"gotest.tools/v3/assert"
+)
+
+// fakeSpacesServer serves the Spaces API over HTTP, so that tests can go through a real
+// client.APIClient rather than a fake one. It records every request, with gzipped bodies
+// decompressed, and responds with a status code set by failEndpoint or else with success.
+// Creating a run responds with run-id. Other requests respond with an empty object.
+type fakeSpacesServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []fakeSpacesRequest
+	failures map[string]fakeSpacesFailure // keyed by "METHOD path"
+}
+
+// fakeSpacesFailure is how a fakeSpacesServer fails requests to an endpoint
+type fakeSpacesFailure struct {
+	statusCode int
+	header     http.Header
+	// times is how many requests fail before the endpoint succeeds again. 0 fails every request.
+	times int
+}
+
+// newFakeSpacesServer starts a fakeSpacesServer that is closed when the test ends
+func newFakeSpacesServer(t *testing.T) *fakeSpacesServer {
+	t.Helper()
+	s := &fakeSpacesServer{failures: map[string]fakeSpacesFailure{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeSpacesServer) handle(w http.ResponseWriter, req *http.Request) {
+	defer func() { _ = req.Body.Close() }()
+	body, err := io.ReadAll(req.Body)
+	if err == nil && req.Header.Get("Content-Encoding") == "gzip" {
+		var reader *gzip.Reader
+		if reader, err = gzip.NewReader(bytes.NewReader(body)); err == nil {
+			body, err = io.ReadAll(reader)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, fakeSpacesRequest{method: req.Method, url: req.URL.Path, body: body, headers: req.Header})
+	key := req.Method + " " + req.URL.Path
+	failure, failed := s.failures[key]
+	if failed && failure.times > 0 {
+		failure.times--
+		if failure.times == 0 {
+			delete(s.failures, key)
+		} else {
+			s.failures[key] = failure
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case failed:
+		for name, values := range failure.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(failure.statusCode)
+		_, _ = w.Write([]byte(`{"error":"failed by fakeSpacesServer"}`))
+	case req.Method == http.MethodPost && req.URL.Path == "/v0/spaces/space-id/runs":
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"id":"run-id","url":"%s/run-id"}`, s.URL)))
+	default:
+		_, _ = w.Write([]byte("{}"))
+	}
+}
+
+// failEndpoint makes every request with the given method and path fail with statusCode
+func (s *fakeSpacesServer) failEndpoint(method string, path string, statusCode int) {
+	s.failEndpointTimes(method, path, statusCode, 0, nil)
+}
+
+// failEndpointTimes makes the next times requests with the given method and path fail with
+// statusCode and header, and then succeed
+func (s *fakeSpacesServer) failEndpointTimes(method string, path string, statusCode int, times int, header http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method+" "+path] = fakeSpacesFailure{statusCode: statusCode, header: header, times: times}
+}
+
+// requestsTo returns the requests received for path, in the order they were received
+func (s *fakeSpacesServer) requestsTo(path string) []fakeSpacesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := []fakeSpacesRequest{}
+	for _, request := range s.requests {
+		if request.url == path {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// newMeta returns a Meta like newTestMeta's, that records its run to this server with an
+// API client that's set up the same as NewRunSummary's
+func (s *fakeSpacesServer) newMeta(taskCount int) *Meta {
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: s.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	return newTestMeta(apiClient.WithoutRetries(), taskCount)
+}
+
+func TestRecord_fakeServer(t *testing.T) {
+	server := newFakeSpacesServer(t)
+	rsm := server.newMeta(3)
+	rsm.spacesClient.compressThreshold = 100
+
+	runURL, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, runURL, server.URL+"/run-id")
+
+	created := server.requestsTo("/v0/spaces/space-id/runs")
+	assert.Equal(t, len(created), 1)
+	assert.Equal(t, created[0].method, http.MethodPost)
+	assert.Equal(t, created[0].headers.Get("Authorization"), "Bearer my-token")
+	run := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(created[0].body, run))
+	assert.Equal(t, run.Status, spacesRunStatusRunning)
+
+	tasks := server.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")
+	assert.Equal(t, len(tasks), 3)
+	taskIDs := map[string]bool{}
+	for _, request := range tasks {
+		task := &spacesTask{}
+		assert.NilError(t, json.Unmarshal(request.body, task))
+		taskIDs[task.Key] = true
+	}
+	assert.DeepEqual(t, taskIDs, map[string]bool{"my-app#build-0": true, "my-app#build-1": true, "my-app#build-2": true})
+
+	done := server.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(done), 1)
+	assert.Equal(t, done[0].method, http.MethodPatch)
+	finished := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(done[0].body, finished))
+	assert.Equal(t, finished.Status, spacesRunStatusCompleted)
+	assert.Equal(t, finished.TotalTasks, 3)
+}
+
+func TestRecord_fakeServerFailedTasks(t *testing.T) {
+	server := newFakeSpacesServer(t)
+	server.failEndpoint(http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", http.StatusUnprocessableEntity)
+	rsm := server.newMeta(2)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 2)
+	for _, err := range errs {
+		httpErr := &HTTPError{}
+		assert.Assert(t, errors.As(err, &httpErr))
+		assert.Equal(t, httpErr.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	// the run is still finished, even though its tasks couldn't be recorded
+	assert.Equal(t, len(server.requestsTo("/v0/spaces/space-id/runs/run-id")), 1)
+}
+
+func TestRecord_fakeServerServerErrors(t *testing.T) {
+	server := newFakeSpacesServer(t)
+	// More failures than the API client allows before it stops sending requests altogether
+	server.failEndpointTimes(http.MethodPost, "/v0/spaces/space-id/runs", http.StatusServiceUnavailable, 2, nil)
+	server.failEndpointTimes(http.MethodPatch, "/v0/spaces/space-id/runs/run-id", http.StatusTooManyRequests, 2, nil)
+	rsm := server.newMeta(2)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	// Each failure is retried once by the spaces client, and not again by the API client
+	assert.Equal(t, len(server.requestsTo("/v0/spaces/space-id/runs")), 3)
+	assert.Equal(t, len(server.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 2)
+	assert.Equal(t, len(server.requestsTo("/v0/spaces/space-id/runs/run-id")), 3)
+}
+
+func TestMakeRequest_fakeServerRetryAfter(t *testing.T) {
+	server := newFakeSpacesServer(t)
+	server.failEndpointTimes(http.MethodPost, "/v0/spaces/space-id/runs", http.StatusTooManyRequests, 1, http.Header{"Retry-After": []string{"7"}})
+	rsm := server.newMeta(0)
+	clock := newFakeClock()
+	rsm.spacesClient.clock = clock
+
+	_, err := rsm.spacesClient.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte("{}"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(server.requestsTo("/v0/spaces/space-id/runs")), 2)
+	// The retry waited as long as the response asked, rather than the usual backoff
+	assert.Equal(t, clock.Now().Sub(time.UnixMilli(0)), 7*time.Second)
+}
+
+func TestMakeRequest_timeoutsDontStopRequests(t *testing.T) {
+	slow := int32(4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		if atomic.AddInt32(&slow, -1) >= 0 {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	c := newTestSpacesClient(apiClient.WithoutRetries())
+	c.requestTimeout = 20 * time.Millisecond
+	c.retry.maxAttempts = 1
+
+	// More timeouts than the API client allows failures, which used to stop every later request
+	for i := 0; i < 4; i++ {
+		_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", []byte("{}"))
+		assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+	}
+	_, err := c.makeRequest(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/run-id", []byte("{}"))
+	assert.NilError(t, err)
+}
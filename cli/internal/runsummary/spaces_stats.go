@@ -0,0 +1,106 @@
+package runsummary
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/cache"
+)
+
+// SpacesStats summarizes the requests made to Spaces while recording a run
+type SpacesStats struct {
+	Requests  int           // number of requests made, counting retries of a request once
+	P50       time.Duration // median time to complete a request, including retries
+	P95       time.Duration // 95th percentile time to complete a request, including retries
+	BytesSent int64         // total size of the request bodies sent, after compression
+}
+
+// spacesStats collects timings for requests to Spaces. It is safe for concurrent use.
+type spacesStats struct {
+	mu        sync.Mutex
+	durations []time.Duration
+	bytesSent int64
+}
+
+func (s *spacesStats) recordRequest(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.durations = append(s.durations, duration)
+}
+
+func (s *spacesStats) recordBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytesSent += int64(n)
+}
+
+func (s *spacesStats) summary() SpacesStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	durations := make([]time.Duration, len(s.durations))
+	copy(durations, s.durations)
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	return SpacesStats{
+		Requests:  len(durations),
+		P50:       percentile(durations, 50),
+		P95:       percentile(durations, 95),
+		BytesSent: s.bytesSent,
+	}
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// spacesTaskStats are timings of the run's tasks, grouped by task name. When a task runs in many
+// workspaces, e.g. build in every package, this shows how long it usually takes.
+type spacesTaskStats struct {
+	SchemaVersion string                `json:"schemaVersion"`
+	Tasks         []spacesTaskNameStats `json:"tasks"` // sorted by name
+}
+
+// spacesTaskNameStats are timings of the tasks with one name, in milliseconds
+type spacesTaskNameStats struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"` // number of workspaces the task ran in
+	Min    int64  `json:"min"`
+	Median int64  `json:"median"`
+	Max    int64  `json:"max"`
+}
+
+// newSpacesTaskStatsPayload groups the durations of tasks by task name. Cache hits are left out,
+// since restoring a task from the cache says nothing about how long it takes to run.
+func (rsm *Meta) newSpacesTaskStatsPayload() *spacesTaskStats {
+	durations := map[string][]time.Duration{}
+	for _, task := range rsm.RunSummary.Tasks {
+		if task.Execution == nil || task.CacheSummary.Status == cache.CacheEventHit {
+			continue
+		}
+		durations[task.Task] = append(durations[task.Task], task.Execution.Duration)
+	}
+
+	stats := make([]spacesTaskNameStats, 0, len(durations))
+	for name, taskDurations := range durations {
+		sort.Slice(taskDurations, func(i, j int) bool { return taskDurations[i] < taskDurations[j] })
+		stats = append(stats, spacesTaskNameStats{
+			Name:   name,
+			Count:  len(taskDurations),
+			Min:    taskDurations[0].Milliseconds(),
+			Median: percentile(taskDurations, 50).Milliseconds(),
+			Max:    taskDurations[len(taskDurations)-1].Milliseconds(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return &spacesTaskStats{Tasks: stats}
+}
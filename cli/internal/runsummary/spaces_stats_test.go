@@ -0,0 +1,167 @@
+package runsummary
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/cache"
+	"gotest.tools/v3/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	durations := make([]time.Duration, 20)
+	for i := range durations {
+		durations[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	assert.Equal(t, percentile(nil, 50), time.Duration(0))
+	assert.Equal(t, percentile(durations[:1], 95), time.Millisecond)
+	assert.Equal(t, percentile(durations, 50), 10*time.Millisecond)
+	assert.Equal(t, percentile(durations, 95), 19*time.Millisecond)
+	assert.Equal(t, percentile(durations, 100), 20*time.Millisecond)
+}
+
+func TestSpacesStats(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 0)
+	c := rsm.spacesClient
+	body := []byte(`{"status":"completed"}`)
+
+	// 18 fast requests and 2 slow ones
+	for i := 0; i < 20; i++ {
+		api.delay = time.Millisecond
+		if i >= 18 {
+			api.delay = 50 * time.Millisecond
+		}
+		_, err := c.makeRequest(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/run-id", body)
+		assert.NilError(t, err)
+	}
+
+	stats := rsm.SpacesStats()
+	assert.Equal(t, stats.Requests, 20)
+	assert.Equal(t, stats.BytesSent, int64(20*len(body)))
+	assert.Assert(t, stats.P50 >= time.Millisecond && stats.P50 < 50*time.Millisecond, "p50 %v", stats.P50)
+	assert.Assert(t, stats.P95 >= 50*time.Millisecond, "p95 %v", stats.P95)
+}
+
+func TestSpacesStats_bytesSent(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 0)
+	c := rsm.spacesClient
+	c.compressThreshold = 100
+
+	small := []byte(`{"status":"completed"}`)
+	medium := []byte(`{"logs":"` + strings.Repeat("a", 50) + `"}`)
+	// large is gzipped before it's sent, so only its compressed size counts
+	large := []byte(`{"logs":"` + strings.Repeat("a", 1000) + `"}`)
+	compressed, _ := c.encodeBody(http.MethodPost, large)
+	assert.Assert(t, len(compressed) < len(large))
+
+	var wg sync.WaitGroup
+	for _, body := range [][]byte{small, medium, large} {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(body []byte) {
+				defer wg.Done()
+				_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", body)
+				assert.Check(t, err)
+			}(body)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, rsm.SpacesStats().BytesSent, int64(10*(len(small)+len(medium)+len(compressed))))
+}
+
+func TestSpacesStats_fakeClock(t *testing.T) {
+	clock := newFakeClock()
+	api := &fakeSpacesAPI{failures: 1, err: errors.New("connection reset")}
+	rsm := newTestMeta(api, 0)
+	c := rsm.spacesClient
+	c.clock = clock
+	c.retry.baseDelay = time.Second
+
+	// each request takes as many seconds as the number of requests before it
+	requests := 0
+	api.onRequest = func(request fakeSpacesRequest) {
+		clock.advance(time.Duration(requests) * time.Second)
+		requests++
+	}
+
+	// the first request fails and is retried, which adds the backoff to its duration
+	for i := 0; i < 3; i++ {
+		_, err := c.makeRequest(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/run-id", []byte(`{}`))
+		assert.NilError(t, err)
+	}
+
+	stats := rsm.SpacesStats()
+	assert.Equal(t, stats.Requests, 3)
+	// attempts take 0s and 1s, with 1-1.5s of backoff in between
+	first := c.stats.durations[0]
+	assert.Assert(t, first >= 2*time.Second && first <= 2500*time.Millisecond, "first request took %v", first)
+	assert.Equal(t, c.stats.durations[1], 2*time.Second)
+	assert.Equal(t, c.stats.durations[2], 3*time.Second)
+	assert.Equal(t, stats.P95, 3*time.Second)
+}
+
+func TestNewSpacesTaskStatsPayload(t *testing.T) {
+	newTask := func(taskID string, duration time.Duration) *TaskSummary {
+		task := newTestTaskSummary(taskID)
+		task.Task = taskID[strings.Index(taskID, "#")+1:]
+		task.Execution.Duration = duration
+		return task
+	}
+	cacheHit := newTask("docs#build", 50*time.Millisecond)
+	cacheHit.CacheSummary.Status = cache.CacheEventHit
+	notRun := newTask("ui#test", 0)
+	notRun.Execution = nil
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.RunSummary.Tasks = []*TaskSummary{
+		newTask("web#build", 10*time.Second),
+		newTask("ui#build", time.Second),
+		newTask("config#build", 3*time.Second),
+		newTask("api#build", 2*time.Second),
+		newTask("web#lint", 1500*time.Millisecond),
+		cacheHit,
+		notRun,
+	}
+
+	stats := rsm.newSpacesTaskStatsPayload()
+	assert.DeepEqual(t, stats.Tasks, []spacesTaskNameStats{
+		{Name: "build", Count: 4, Min: 1000, Median: 2000, Max: 10000},
+		{Name: "lint", Count: 1, Min: 1500, Median: 1500, Max: 1500},
+	})
+}
+
+func TestRecord_taskStats(t *testing.T) {
+	for _, sendTaskStats := range []bool{true, false} {
+		api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+		rsm := newTestMeta(api, 2)
+		rsm.sendTaskStats = sendTaskStats
+
+		_, errs := rsm.record(context.Background())
+		assert.Equal(t, len(errs), 0)
+		statsRequests := api.requestsTo("/v0/spaces/space-id/runs/run-id/task-stats")
+		if !sendTaskStats {
+			assert.Equal(t, len(statsRequests), 0)
+			continue
+		}
+		assert.Equal(t, len(statsRequests), 1)
+		// they're sent once every task has been sent, before the run is marked as done
+		assert.Equal(t, api.requests[3].url, "/v0/spaces/space-id/runs/run-id/task-stats")
+		assert.Equal(t, api.requests[4].url, "/v0/spaces/space-id/runs/run-id")
+
+		stats := &spacesTaskStats{}
+		assert.NilError(t, json.Unmarshal(statsRequests[0].body, stats))
+		assert.Equal(t, stats.SchemaVersion, spacesSchemaVersion)
+		assert.Equal(t, len(stats.Tasks), 1)
+		assert.Equal(t, stats.Tasks[0].Count, 2)
+	}
+}
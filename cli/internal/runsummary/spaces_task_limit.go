@@ -0,0 +1,100 @@
+package runsummary
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vercel/turbo/cli/internal/env"
+)
+
+// spacesTaskSelection is how tasks are picked when a run has more tasks than can be sent to Spaces
+type spacesTaskSelection string
+
+const (
+	// spacesSelectSlowest sends the tasks that took longest to run
+	spacesSelectSlowest spacesTaskSelection = "slowest"
+	// spacesSelectFailedFirst sends the tasks that failed, followed by the rest in run order
+	spacesSelectFailedFirst spacesTaskSelection = "failed-first"
+	// spacesSelectFirst sends the first tasks in run order
+	spacesSelectFirst spacesTaskSelection = "first"
+)
+
+// spacesTaskLimit caps the number of task summaries sent to Spaces for a run
+type spacesTaskLimit struct {
+	// max is the most task summaries that are sent. 0 sends every task.
+	max      int
+	strategy spacesTaskSelection
+}
+
+// getSpacesTaskLimit returns the cap set by spacesMaxTasksEnvVar and spacesMaxTasksStrategyEnvVar.
+// Without a cap, every task is sent.
+func getSpacesTaskLimit(envVars env.EnvironmentVariableMap) (spacesTaskLimit, error) {
+	limit := spacesTaskLimit{strategy: spacesSelectSlowest}
+	if value := strings.TrimSpace(envVars[spacesMaxTasksEnvVar]); value != "" {
+		maxTasks, err := strconv.Atoi(value)
+		if err != nil || maxTasks < 1 {
+			return spacesTaskLimit{}, fmt.Errorf("%w %q: %v has to be a positive number", ErrInvalidTaskLimit, value, spacesMaxTasksEnvVar)
+		}
+		limit.max = maxTasks
+	}
+
+	switch strategy := spacesTaskSelection(strings.TrimSpace(envVars[spacesMaxTasksStrategyEnvVar])); strategy {
+	case "":
+		// picks the slowest tasks
+	case spacesSelectSlowest, spacesSelectFailedFirst, spacesSelectFirst:
+		limit.strategy = strategy
+	default:
+		return spacesTaskLimit{}, fmt.Errorf("%w %q: %v has to be one of %q, %q or %q", ErrInvalidTaskLimit, strategy, spacesMaxTasksStrategyEnvVar, spacesSelectSlowest, spacesSelectFailedFirst, spacesSelectFirst)
+	}
+	return limit, nil
+}
+
+// apply returns the tasks that are sent when the run has taskSummaries. The tasks are
+// returned in the order they're in in taskSummaries, whichever strategy picked them.
+func (l spacesTaskLimit) apply(taskSummaries []*TaskSummary) []*TaskSummary {
+	if l.max == 0 || len(taskSummaries) <= l.max {
+		return taskSummaries
+	}
+
+	ranked := make([]int, len(taskSummaries))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	switch l.strategy {
+	case spacesSelectSlowest:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return spacesTaskDuration(taskSummaries[ranked[i]]) > spacesTaskDuration(taskSummaries[ranked[j]])
+		})
+	case spacesSelectFailedFirst:
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return spacesTaskFailed(taskSummaries[ranked[i]]) && !spacesTaskFailed(taskSummaries[ranked[j]])
+		})
+	}
+
+	selected := ranked[:l.max]
+	sort.Ints(selected)
+	limited := make([]*TaskSummary, len(selected))
+	for i, index := range selected {
+		limited[i] = taskSummaries[index]
+	}
+	return limited
+}
+
+// spacesTaskDuration returns how long task ran for, which is 0 for tasks that didn't run
+func spacesTaskDuration(task *TaskSummary) int64 {
+	if task.Execution == nil {
+		return 0
+	}
+	return int64(task.Execution.Duration)
+}
+
+// spacesTaskFailed returns whether task ran and exited with a non-zero exit code
+func spacesTaskFailed(task *TaskSummary) bool {
+	if task.Execution == nil {
+		return false
+	}
+	exitCode := task.Execution.ExitCode()
+	return exitCode != nil && *exitCode != 0
+}
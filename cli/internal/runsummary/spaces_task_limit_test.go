@@ -0,0 +1,119 @@
+package runsummary
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/vercel/turbo/cli/internal/env"
+	"gotest.tools/v3/assert"
+)
+
+// newTestLimitTasks returns tasks that took the given number of seconds, and failed for negative numbers
+func newTestLimitTasks(seconds ...int) []*TaskSummary {
+	tasks := make([]*TaskSummary, len(seconds))
+	for i, s := range seconds {
+		tasks[i] = newTestTaskSummary(string(rune('a' + i)))
+		if s < 0 {
+			exitCode := 1
+			tasks[i].Execution.exitCode = &exitCode
+			s = -s
+		}
+		tasks[i].Execution.Duration = time.Duration(s) * time.Second
+	}
+	return tasks
+}
+
+func TestSpacesTaskLimit_apply(t *testing.T) {
+	testCases := []struct {
+		name  string
+		limit spacesTaskLimit
+		want  []string
+	}{
+		{name: "no limit", limit: spacesTaskLimit{strategy: spacesSelectSlowest}, want: []string{"a", "b", "c", "d", "e"}},
+		{name: "under the limit", limit: spacesTaskLimit{max: 5, strategy: spacesSelectFirst}, want: []string{"a", "b", "c", "d", "e"}},
+		{name: "slowest", limit: spacesTaskLimit{max: 2, strategy: spacesSelectSlowest}, want: []string{"b", "e"}},
+		{name: "failed first", limit: spacesTaskLimit{max: 3, strategy: spacesSelectFailedFirst}, want: []string{"a", "c", "d"}},
+		{name: "fewer failed than the limit", limit: spacesTaskLimit{max: 1, strategy: spacesSelectFailedFirst}, want: []string{"c"}},
+		{name: "first", limit: spacesTaskLimit{max: 3, strategy: spacesSelectFirst}, want: []string{"a", "b", "c"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tasks := newTestLimitTasks(1, 9, -2, -3, 8)
+			taskIDs := []string{}
+			for _, task := range tc.limit.apply(tasks) {
+				taskIDs = append(taskIDs, task.TaskID)
+			}
+			assert.DeepEqual(t, taskIDs, tc.want)
+		})
+	}
+}
+
+func TestSpacesTaskLimit_applyWithoutExecution(t *testing.T) {
+	tasks := newTestLimitTasks(1, 2)
+	tasks[1].Execution = nil
+
+	limited := spacesTaskLimit{max: 1, strategy: spacesSelectSlowest}.apply(tasks)
+	assert.Equal(t, len(limited), 1)
+	assert.Equal(t, limited[0].TaskID, "a")
+}
+
+func TestGetSpacesTaskLimit(t *testing.T) {
+	testCases := []struct {
+		name    string
+		envVars env.EnvironmentVariableMap
+		want    spacesTaskLimit
+		wantErr bool
+	}{
+		{name: "unset", envVars: env.EnvironmentVariableMap{}, want: spacesTaskLimit{strategy: spacesSelectSlowest}},
+		{name: "max only", envVars: env.EnvironmentVariableMap{spacesMaxTasksEnvVar: "500"}, want: spacesTaskLimit{max: 500, strategy: spacesSelectSlowest}},
+		{name: "max and strategy", envVars: env.EnvironmentVariableMap{spacesMaxTasksEnvVar: " 10 ", spacesMaxTasksStrategyEnvVar: "failed-first"}, want: spacesTaskLimit{max: 10, strategy: spacesSelectFailedFirst}},
+		{name: "first", envVars: env.EnvironmentVariableMap{spacesMaxTasksEnvVar: "10", spacesMaxTasksStrategyEnvVar: "first"}, want: spacesTaskLimit{max: 10, strategy: spacesSelectFirst}},
+		{name: "zero", envVars: env.EnvironmentVariableMap{spacesMaxTasksEnvVar: "0"}, wantErr: true},
+		{name: "not a number", envVars: env.EnvironmentVariableMap{spacesMaxTasksEnvVar: "lots"}, wantErr: true},
+		{name: "unknown strategy", envVars: env.EnvironmentVariableMap{spacesMaxTasksEnvVar: "10", spacesMaxTasksStrategyEnvVar: "random"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limit, err := getSpacesTaskLimit(tc.envVars)
+			if tc.wantErr {
+				assert.Assert(t, errors.Is(err, ErrInvalidTaskLimit))
+				assert.Equal(t, limit, spacesTaskLimit{})
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, limit, tc.want)
+		})
+	}
+}
+
+func TestRecord_taskLimit(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 0)
+	rsm.RunSummary.Tasks = newTestLimitTasks(1, 9, -2, -3, 8)
+	rsm.taskLimit = spacesTaskLimit{max: 2, strategy: spacesSelectFailedFirst}
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	postedTaskIDs := []string{}
+	for _, request := range api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks") {
+		task := &spacesTask{}
+		assert.NilError(t, json.Unmarshal(request.body, task))
+		postedTaskIDs = append(postedTaskIDs, task.Key)
+	}
+	sort.Strings(postedTaskIDs)
+	assert.DeepEqual(t, postedTaskIDs, []string{"c", "d"})
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(requests[0].body, payload))
+	assert.Equal(t, payload.TotalTasks, 5)
+	assert.Equal(t, payload.SkippedTasks, 3)
+}
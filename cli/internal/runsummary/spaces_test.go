@@ -0,0 +1,2749 @@
+package runsummary
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/mitchellh/cli"
+	"github.com/vercel/turbo/cli/internal/cache"
+	"github.com/vercel/turbo/cli/internal/ci"
+	"github.com/vercel/turbo/cli/internal/client"
+	"github.com/vercel/turbo/cli/internal/env"
+	"github.com/vercel/turbo/cli/internal/fs"
+	"github.com/vercel/turbo/cli/internal/turbopath"
+	"github.com/vercel/turbo/cli/internal/turbostate"
+	"github.com/vercel/turbo/cli/internal/util"
+	"github.com/vercel/turbo/cli/internal/workspace"
+	"gotest.tools/v3/assert"
+)
+
+type fakeSpacesRequest struct {
+	method  string
+	url     string
+	body    []byte
+	headers http.Header
+}
+
+// fakeSpacesAPI records requests and fails the first `failures` of them with `err`.
+// If block is set, each request waits for it to be closed before returning.
+// If delay is set, each request takes that long unless its context is done first.
+// If onRequest is set, it is called with each request as it is received.
+// It is linked to a Space unless unlinked is set.
+type fakeSpacesAPI struct {
+	mu        sync.Mutex
+	requests  []fakeSpacesRequest
+	failures  int
+	err       error
+	response  []byte
+	block     chan struct{}
+	delay     time.Duration
+	onRequest func(request fakeSpacesRequest)
+	unlinked  bool
+}
+
+func (f *fakeSpacesAPI) do(ctx context.Context, method string, url string, body []byte, headers http.Header) ([]byte, error) {
+	request := fakeSpacesRequest{method: method, url: url, body: body, headers: headers}
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	failed := len(f.requests) <= f.failures
+	f.mu.Unlock()
+
+	if f.onRequest != nil {
+		f.onRequest(request)
+	}
+	if f.block != nil {
+		<-f.block
+	}
+	if f.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(f.delay):
+		}
+	}
+	if failed {
+		return nil, f.err
+	}
+	return f.response, nil
+}
+
+func (f *fakeSpacesAPI) requestsTo(url string) []fakeSpacesRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := []fakeSpacesRequest{}
+	for _, request := range f.requests {
+		if request.url == url {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func (f *fakeSpacesAPI) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func (f *fakeSpacesAPI) JSONPostWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	return f.do(ctx, http.MethodPost, url, body, headers)
+}
+
+func (f *fakeSpacesAPI) JSONPatchWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	return f.do(ctx, http.MethodPatch, url, body, headers)
+}
+
+func (f *fakeSpacesAPI) JSONPutWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	return f.do(ctx, http.MethodPut, url, body, headers)
+}
+
+func (f *fakeSpacesAPI) IsLinked() bool {
+	return !f.unlinked
+}
+
+func newTestSpacesClient(api spacesAPIClient) *spacesClient {
+	c := newSpacesClient(api, env.EnvironmentVariableMap{})
+	c.retry.baseDelay = time.Millisecond
+	c.createRetry.baseDelay = time.Millisecond
+	return c
+}
+
+func newTestTaskSummary(taskID string) *TaskSummary {
+	exitCode := 0
+	return &TaskSummary{
+		TaskID: taskID,
+		Execution: &TaskExecutionSummary{
+			startAt:  time.Now(),
+			Duration: time.Second,
+			exitCode: &exitCode,
+		},
+	}
+}
+
+func newTestMeta(api spacesAPIClient, taskCount int) *Meta {
+	tasks := make([]*TaskSummary, taskCount)
+	for i := range tasks {
+		tasks[i] = newTestTaskSummary(fmt.Sprintf("my-app#build-%d", i))
+	}
+	return &Meta{
+		RunSummary: &RunSummary{
+			ExecutionSummary: &executionSummary{startedAt: time.Now()},
+			Tasks:            tasks,
+			SCM:              &scmState{},
+			TurboVersion:     "1.0.0",
+		},
+		ui:                 cli.NewMockUi(),
+		spacesClient:       newTestSpacesClient(api),
+		logRedactor:        &logRedactor{},
+		uploadLogs:         true,
+		spaceID:            "space-id",
+		synthesizedCommand: "turbo run build",
+	}
+}
+
+func TestSpacesClient_makeRequestLogging(t *testing.T) {
+	testCases := []struct {
+		name      string
+		level     hclog.Level
+		logBodies bool
+		want      []string
+		notWant   []string
+	}{
+		{
+			name:    "verbose",
+			level:   hclog.Debug,
+			want:    []string{"spaces request", "method=POST", "url=/v0/spaces/space-id/runs", "attempt=1", "status=ok", "body=\"<16 bytes redacted>\""},
+			notWant: []string{"secret"},
+		},
+		{
+			name:      "verbose with bodies",
+			level:     hclog.Debug,
+			logBodies: true,
+			want:      []string{"spaces request", "status=ok", "secret"},
+		},
+		{
+			name:    "normal verbosity",
+			level:   hclog.Info,
+			notWant: []string{"spaces request"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := newTestSpacesClient(&fakeSpacesAPI{})
+			c.logger = hclog.New(&hclog.LoggerOptions{Output: &out, Level: tc.level})
+			c.logBodies = tc.logBodies
+
+			_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{"key":"secret"}`))
+			assert.NilError(t, err)
+
+			for _, want := range tc.want {
+				assert.Assert(t, strings.Contains(out.String(), want), "%v not in %q", want, out.String())
+			}
+			for _, notWant := range tc.notWant {
+				assert.Assert(t, !strings.Contains(out.String(), notWant), "%v in %q", notWant, out.String())
+			}
+		})
+	}
+}
+
+func TestSpacesClient_makeRequestLogsStatus(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestSpacesClient(&fakeSpacesAPI{failures: 1, err: &client.StatusError{StatusCode: http.StatusBadRequest}})
+	c.logger = hclog.New(&hclog.LoggerOptions{Output: &out, Level: hclog.Debug})
+
+	_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{}`))
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.Contains(out.String(), "status=400"), out.String())
+}
+
+func TestSpacesClient_userAgent(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	c := newTestSpacesClient(api)
+	c.setUserAgent("1.2.3")
+
+	_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{}`))
+	assert.NilError(t, err)
+	assert.Equal(t, api.requests[0].headers.Get("User-Agent"), fmt.Sprintf("turbo/1.2.3 (%v/%v)", runtime.GOOS, runtime.GOARCH))
+}
+
+func TestSpacesClient_makeRequestRetries(t *testing.T) {
+	testCases := []struct {
+		name         string
+		failures     int
+		err          error
+		wantRequests int
+		wantErr      bool
+	}{
+		{
+			name:         "succeeds first time",
+			failures:     0,
+			wantRequests: 1,
+		},
+		{
+			name:         "retries network errors",
+			failures:     2,
+			err:          errors.New("connection reset by peer"),
+			wantRequests: 3,
+		},
+		{
+			name:         "retries 5xx responses",
+			failures:     1,
+			err:          &client.StatusError{StatusCode: http.StatusServiceUnavailable},
+			wantRequests: 2,
+		},
+		{
+			name:         "gives up after max attempts",
+			failures:     5,
+			err:          &client.StatusError{StatusCode: http.StatusBadGateway},
+			wantRequests: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "retries 429 responses",
+			failures:     1,
+			err:          &client.StatusError{StatusCode: http.StatusTooManyRequests},
+			wantRequests: 2,
+		},
+		{
+			name:         "does not retry 4xx responses",
+			failures:     1,
+			err:          &client.StatusError{StatusCode: http.StatusBadRequest},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "does not retry when remote failures are exhausted",
+			failures:     1,
+			err:          client.ErrTooManyFailures,
+			wantRequests: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &fakeSpacesAPI{failures: tc.failures, err: tc.err, response: []byte("{}")}
+			c := newTestSpacesClient(api)
+
+			resp, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte("{}"))
+			assert.Equal(t, len(api.requests), tc.wantRequests)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, tc.err)
+			} else {
+				assert.NilError(t, err)
+				assert.Equal(t, string(resp), "{}")
+			}
+		})
+	}
+}
+
+func TestSpacesClient_makeRequestRespectsDeadline(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 5, err: errors.New("connection reset by peer")}
+	c := newSpacesClient(api, env.EnvironmentVariableMap{})
+	c.retry.baseDelay = time.Second
+	c.retry.requestDeadline = 100 * time.Millisecond
+
+	_, err := c.makeRequest(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/run-id", []byte("{}"))
+	assert.ErrorContains(t, err, "connection reset by peer")
+	assert.Equal(t, len(api.requests), 1)
+}
+
+func TestSpacesClient_makeRequestTimeout(t *testing.T) {
+	api := &fakeSpacesAPI{delay: 5 * time.Second}
+	c := newTestSpacesClient(api)
+	c.retry.maxAttempts = 1
+	c.requestTimeout = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte("{}"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Assert(t, time.Since(start) < time.Second)
+}
+
+func TestPostTaskSummaries_timeout(t *testing.T) {
+	api := &fakeSpacesAPI{delay: 5 * time.Second}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.retry.maxAttempts = 1
+	rsm.spacesClient.requestTimeout = 10 * time.Millisecond
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 3)
+	for _, err := range errs {
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+}
+
+func gunzip(t *testing.T, body []byte) []byte {
+	t.Helper()
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	assert.NilError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	assert.NilError(t, err)
+	return decompressed
+}
+
+func TestNewSpacesRunCreatePayload_githubActions(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "true")
+	envVars := env.EnvironmentVariableMap{
+		"GITHUB_SERVER_URL": "https://github.com",
+		"GITHUB_REPOSITORY": "vercel/turbo",
+		"GITHUB_RUN_ID":     "1234",
+	}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.ciJobURL = getCIJobURL(envVars)
+	payload := rsm.newSpacesRunCreatePayload()
+
+	assert.Equal(t, payload.Platform, runtime.GOOS+"/"+runtime.GOARCH)
+	assert.Equal(t, payload.CIJobURL, "https://github.com/vercel/turbo/actions/runs/1234")
+}
+
+func TestNewSpacesRunCreatePayload_repo(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.SetPackageManager("pnpm")
+	rsm.workspaceCount = countWorkspaces(workspace.Catalog{
+		PackageJSONs: map[string]*fs.PackageJSON{
+			util.RootPkgName: {},
+			"web":            {},
+			"docs":           {},
+		},
+	})
+
+	payload := rsm.newSpacesRunCreatePayload()
+	assert.Equal(t, payload.PackageManager, "pnpm")
+	assert.Equal(t, payload.WorkspaceCount, 2)
+}
+
+func TestNewSpacesRunCreatePayload_name(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	assert.Equal(t, rsm.newSpacesRunCreatePayload().Name, "turbo run build")
+
+	rsm.runName = "Nightly build"
+	payload := rsm.newSpacesRunCreatePayload()
+	assert.Equal(t, payload.Name, "Nightly build")
+	assert.Equal(t, payload.Command, "turbo run build")
+
+	rsm.SetSpacesRunName("  Release  ")
+	assert.Equal(t, rsm.newSpacesRunCreatePayload().Name, "Release")
+
+	rsm.SetSpacesRunName("")
+	assert.Equal(t, rsm.newSpacesRunCreatePayload().Name, "turbo run build")
+}
+
+func TestNewSpacesRunCreatePayload_daemonEnabled(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	body, err := json.Marshal(rsm.newSpacesRunCreatePayload())
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(body), `"daemonEnabled":false`), string(body))
+
+	rsm.daemonEnabled = true
+	body, err = json.Marshal(rsm.newSpacesRunCreatePayload())
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(body), `"daemonEnabled":true`), string(body))
+
+	// it's only sent when the run is created
+	body, err = json.Marshal(rsm.newSpacesDonePayload())
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), `"daemonEnabled"`), string(body))
+}
+
+func TestGetCIJobURL(t *testing.T) {
+	t.Run("from the vendor's env var", func(t *testing.T) {
+		t.Setenv("GITLAB_CI", "true")
+		envVars := env.EnvironmentVariableMap{"CI_JOB_URL": "https://gitlab.com/vercel/turbo/-/jobs/1234"}
+		assert.Equal(t, getCIJobURL(envVars), "https://gitlab.com/vercel/turbo/-/jobs/1234")
+	})
+
+	t.Run("incomplete GitHub Actions env", func(t *testing.T) {
+		t.Setenv("GITHUB_ACTIONS", "true")
+		envVars := env.EnvironmentVariableMap{"GITHUB_SERVER_URL": "https://github.com"}
+		assert.Equal(t, getCIJobURL(envVars), "")
+	})
+}
+
+func TestGetRunContext(t *testing.T) {
+	githubActions := ci.Vendor{Name: "GitHub Actions", Constant: "GITHUB_ACTIONS"}
+	testCases := []struct {
+		name    string
+		envVars env.EnvironmentVariableMap
+		vendor  ci.Vendor
+		want    string
+	}{
+		{name: "recognized CI", envVars: env.EnvironmentVariableMap{"CI": "true"}, vendor: githubActions, want: "GITHUB_ACTIONS"},
+		{name: "unrecognized CI", envVars: env.EnvironmentVariableMap{"CI": "true"}, want: "CI"},
+		{name: "unrecognized CI with CONTINUOUS_INTEGRATION", envVars: env.EnvironmentVariableMap{"CONTINUOUS_INTEGRATION": "1"}, want: "CI"},
+		{name: "CI turned off", envVars: env.EnvironmentVariableMap{"CI": "false"}, want: "LOCAL"},
+		{name: "local", envVars: env.EnvironmentVariableMap{}, want: "LOCAL"},
+		{name: "override", envVars: env.EnvironmentVariableMap{"CI": "true", spacesRunContextEnvVar: "BUILDKITE"}, vendor: githubActions, want: "BUILDKITE"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, getRunContext(tc.envVars, tc.vendor), tc.want)
+
+			rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+			rsm.runContext = getRunContext(tc.envVars, tc.vendor)
+			assert.Equal(t, rsm.newSpacesRunCreatePayload().Context, tc.want)
+		})
+	}
+}
+
+func TestSpacesEndpoints(t *testing.T) {
+	testCases := []struct {
+		basePath string
+		want     string
+	}{
+		{basePath: "", want: "/v0/spaces"},
+		{basePath: "/v1/spaces", want: "/v1/spaces"},
+		{basePath: "api/spaces/", want: "/api/spaces"},
+	}
+
+	for _, tc := range testCases {
+		endpoints := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesBasePathEnvVar: tc.basePath}).endpoints
+		assert.Equal(t, endpoints.runs("space-id"), tc.want+"/space-id/runs", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.run("space-id", "run-id"), tc.want+"/space-id/runs/run-id", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.tasks("space-id", "run-id"), tc.want+"/space-id/runs/run-id/tasks", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.tasksBatch("space-id", "run-id"), tc.want+"/space-id/runs/run-id/tasks/batch", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.task("space-id", "run-id", "my-app#build"), tc.want+"/space-id/runs/run-id/tasks/my-app%23build", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.graph("space-id", "run-id"), tc.want+"/space-id/runs/run-id/graph", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.summary("space-id", "run-id"), tc.want+"/space-id/runs/run-id/summary", "base path %q", tc.basePath)
+		assert.Equal(t, endpoints.taskStats("space-id", "run-id"), tc.want+"/space-id/runs/run-id/task-stats", "base path %q", tc.basePath)
+	}
+}
+
+func TestRecord_customBasePath(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 2)
+	rsm.spacesClient.endpoints = newSpacesEndpoints("/v1/spaces")
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, len(api.requestsTo("/v1/spaces/space-id/runs")), 1)
+	assert.Equal(t, len(api.requestsTo("/v1/spaces/space-id/runs/run-id/tasks")), 2)
+	assert.Equal(t, len(api.requestsTo("/v1/spaces/space-id/runs/run-id")), 1)
+}
+
+func TestGetSpacesLabels(t *testing.T) {
+	labels, errs := getSpacesLabels(env.EnvironmentVariableMap{
+		spacesLabelsEnvVar: "nightly, pr-1234,,nightly,has space,release:v1.2," + strings.Repeat("a", 65),
+	})
+	assert.DeepEqual(t, labels, []string{"nightly", "pr-1234", "release:v1.2"})
+	assert.Equal(t, len(errs), 2)
+	for _, err := range errs {
+		assert.Assert(t, errors.Is(err, ErrInvalidLabel))
+	}
+
+	labels, errs = getSpacesLabels(env.EnvironmentVariableMap{})
+	assert.Equal(t, len(labels), 0)
+	assert.Equal(t, len(errs), 0)
+}
+
+func TestNewSpacesRunCreatePayload_labels(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.labels, _ = getSpacesLabels(env.EnvironmentVariableMap{spacesLabelsEnvVar: "nightly,pr-1234"})
+
+	body, err := json.Marshal(rsm.newSpacesRunCreatePayload())
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(body), `"labels":["nightly","pr-1234"]`), string(body))
+
+	// without labels, the field is left out
+	rsm.labels = nil
+	body, err = json.Marshal(rsm.newSpacesRunCreatePayload())
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), "labels"), string(body))
+}
+
+func TestGetSpacesMirrorIDs(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  []string
+	}{
+		{value: "", want: []string{}},
+		{value: "org-space", want: []string{"org-space"}},
+		{value: " org-space, other-space ,", want: []string{"org-space", "other-space"}},
+		{value: "org-space,space-id,org-space", want: []string{"org-space"}},
+	}
+
+	for _, tc := range testCases {
+		got := getSpacesMirrorIDs(env.EnvironmentVariableMap{spacesMirrorIDsEnvVar: tc.value}, "space-id")
+		assert.DeepEqual(t, got, tc.want)
+	}
+}
+
+func TestRecord_mirrors(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 2)
+	rsm.mirrorSpaceIDs = []string{"org-space"}
+
+	runURL, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, runURL, "https://vercel.com/run")
+	for _, spaceID := range []string{"space-id", "org-space"} {
+		assert.Equal(t, len(api.requestsTo(fmt.Sprintf("/v0/spaces/%s/runs", spaceID))), 1, spaceID)
+		assert.Equal(t, len(api.requestsTo(fmt.Sprintf("/v0/spaces/%s/runs/run-id/tasks", spaceID))), 2, spaceID)
+		done := api.requestsTo(fmt.Sprintf("/v0/spaces/%s/runs/run-id", spaceID))
+		assert.Equal(t, len(done), 1, spaceID)
+		assert.Equal(t, done[0].method, http.MethodPatch)
+	}
+}
+
+func TestRecord_mirrorErrors(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	// every request after the run is done in its own Space is rejected
+	api.onRequest = func(request fakeSpacesRequest) {
+		if request.url == "/v0/spaces/space-id/runs/run-id" {
+			api.mu.Lock()
+			api.failures = len(api.requests) + 100
+			api.mu.Unlock()
+		}
+	}
+	api.err = &client.StatusError{StatusCode: http.StatusForbidden, Body: "forbidden"}
+	rsm := newTestMeta(api, 2)
+	rsm.mirrorSpaceIDs = []string{"org-space"}
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	targetErr := &spacesTargetError{}
+	assert.Assert(t, errors.As(errs[0], &targetErr))
+	assert.Equal(t, targetErr.spaceID, "org-space")
+	assert.ErrorContains(t, errs[0], "space org-space: POST /v0/spaces/org-space/runs: forbidden")
+	httpErr := &HTTPError{}
+	assert.Assert(t, errors.As(errs[0], &httpErr))
+	assert.Equal(t, httpErr.StatusCode, http.StatusForbidden)
+
+	// the run was still recorded to its own Space
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id")), 1)
+}
+
+func TestFormatSpacesSummary(t *testing.T) {
+	testCases := []struct {
+		name   string
+		posted int
+		failed int
+		runURL string
+		want   string
+	}{
+		{name: "all tasks", posted: 120, runURL: "https://vercel.com/run", want: "Spaces: uploaded 120 tasks to https://vercel.com/run"},
+		{name: "some failed", posted: 118, failed: 2, runURL: "https://vercel.com/run", want: "Spaces: uploaded 118 tasks to https://vercel.com/run (2 failed)"},
+		{name: "one task", posted: 1, runURL: "https://vercel.com/run", want: "Spaces: uploaded 1 task to https://vercel.com/run"},
+		{name: "no tasks", runURL: "https://vercel.com/run", want: "Spaces: recorded run with no tasks to https://vercel.com/run"},
+		{name: "no url", posted: 3, want: "Spaces: uploaded 3 tasks"},
+		{name: "every task failed", failed: 3, want: "Spaces: uploaded 0 tasks (3 failed)"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, formatSpacesSummary(tc.posted, tc.failed, tc.runURL), tc.want)
+		})
+	}
+}
+
+func TestPrintSpacesSummary(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	ui := rsm.ui.(*cli.MockUi)
+
+	// nothing is written until the run has been sent
+	rsm.PrintSpacesSummary()
+	assert.Equal(t, ui.OutputWriter.String(), "")
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+	ui.OutputWriter.Reset()
+	rsm.PrintSpacesSummary()
+	assert.Equal(t, ui.OutputWriter.String(), "Spaces: uploaded 3 tasks to https://vercel.com/run\n")
+}
+
+func TestPrintSpacesSummary_mirrors(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.mirrorSpaceIDs = []string{"org-space", "team-space"}
+	ui := rsm.ui.(*cli.MockUi)
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+	ui.OutputWriter.Reset()
+	rsm.PrintSpacesSummary()
+	assert.Equal(t, ui.OutputWriter.String(), "Spaces: uploaded 3 tasks to https://vercel.com/run\n")
+}
+
+func TestRecord_idempotencyKey(t *testing.T) {
+	api := &fakeSpacesAPI{
+		failures: 2,
+		err:      &client.StatusError{StatusCode: http.StatusServiceUnavailable},
+		response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`),
+	}
+	rsm := newTestMeta(api, 1)
+	rsm.mirrorSpaceIDs = []string{"org-space"}
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	creates := api.requestsTo("/v0/spaces/space-id/runs")
+	assert.Equal(t, len(creates), 3)
+	key := creates[0].headers.Get(spacesIdempotencyKeyHeader)
+	assert.Assert(t, key != "")
+	for _, request := range creates {
+		assert.Equal(t, request.headers.Get(spacesIdempotencyKeyHeader), key)
+	}
+
+	// each run that is created has its own key
+	mirrorCreates := api.requestsTo("/v0/spaces/org-space/runs")
+	assert.Equal(t, len(mirrorCreates), 1)
+	assert.Assert(t, mirrorCreates[0].headers.Get(spacesIdempotencyKeyHeader) != key)
+
+	// and it isn't sent with anything else
+	tasks := api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")
+	assert.Equal(t, len(tasks), 1)
+	assert.Equal(t, tasks[0].headers.Get(spacesIdempotencyKeyHeader), "")
+}
+
+func TestRecord_createRetryPolicy(t *testing.T) {
+	api := &taskErrSpacesAPI{
+		fakeSpacesAPI: &fakeSpacesAPI{
+			failures: 2,
+			err:      &client.StatusError{StatusCode: http.StatusServiceUnavailable},
+			response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`),
+		},
+		taskErr: &client.StatusError{StatusCode: http.StatusServiceUnavailable},
+	}
+	rsm := newTestMeta(api, 2)
+	rsm.spacesClient.retry.maxAttempts = 1
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs")), 3)
+	// tasks aren't retried, so each one fails after a single attempt
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 2)
+	assert.Equal(t, len(errs), 2)
+	for _, err := range errs {
+		taskErr := &spacesTaskError{}
+		assert.Assert(t, errors.As(err, &taskErr))
+	}
+}
+
+func TestRecord_invalidRunPayload(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(rsm *Meta)
+		want  string
+	}{
+		{
+			name:  "no start time",
+			setup: func(rsm *Meta) { rsm.RunSummary.ExecutionSummary.startedAt = time.Time{} },
+			want:  "invalid run: missing startTime",
+		},
+		{
+			name:  "no command",
+			setup: func(rsm *Meta) { rsm.synthesizedCommand = "" },
+			want:  "invalid run: missing command",
+		},
+		{
+			name:  "no turbo version",
+			setup: func(rsm *Meta) { rsm.RunSummary.TurboVersion = "" },
+			want:  "invalid run: missing client.version",
+		},
+		{
+			name: "several missing fields",
+			setup: func(rsm *Meta) {
+				rsm.synthesizedCommand = ""
+				rsm.RunSummary.TurboVersion = ""
+			},
+			want: "invalid run: missing command, client.version",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+			rsm := newTestMeta(api, 2)
+			tc.setup(rsm)
+
+			_, errs := rsm.record(context.Background())
+			assert.Equal(t, len(errs), 1)
+			assert.Assert(t, errors.Is(errs[0], ErrInvalidRunPayload))
+			assert.Error(t, errs[0], tc.want)
+			// nothing is sent for a run that the Space would reject
+			assert.Equal(t, len(api.requests), 0)
+		})
+	}
+}
+
+func TestFlush_partialRun(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+
+	// only the first two tasks had finished when turbo was stopped
+	rsm.Flush(rsm.RunSummary.Tasks[:2])
+
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs")), 1)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 2)
+	done := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(done), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(done[0].body, payload))
+	assert.Equal(t, payload.Status, spacesRunStatusInterrupted)
+	assert.Equal(t, payload.Result, spacesRunResultCancelled)
+	assert.Equal(t, payload.TotalTasks, 2)
+	assert.Equal(t, len(rsm.RunSummary.Tasks), 3)
+
+	// the run was already recorded, so Close doesn't send it again
+	requests := api.requestCount()
+	assert.NilError(t, rsm.Close(context.Background(), 1, workspace.Catalog{}))
+	assert.Equal(t, api.requestCount(), requests)
+}
+
+// Flush only records the run to its Space, so Close still saves and prints the summary afterwards
+func TestFlush_closeStillSaves(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 2)
+	rsm.repoRoot = turbopath.AbsoluteSystemPath(t.TempDir())
+	rsm.shouldSave = true
+	rsm.RunSummary.GlobalHashSummary = &GlobalHashSummary{}
+
+	rsm.Flush(rsm.RunSummary.Tasks[:1])
+	requests := api.requestCount()
+	assert.NilError(t, rsm.Close(context.Background(), 1, workspace.Catalog{}))
+	assert.Equal(t, api.requestCount(), requests)
+	assert.Assert(t, rsm.getPath().FileExists())
+}
+
+// A signal can arrive while Close is finishing the run, so Flush and Close run at the same time
+func TestFlush_duringClose(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`), block: make(chan struct{})}
+	rsm := newTestMeta(api, 2)
+
+	flushed := make(chan struct{})
+	go func() {
+		rsm.Flush(rsm.RunSummary.Tasks[:1])
+		close(flushed)
+	}()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- rsm.Close(context.Background(), 1, workspace.Catalog{})
+	}()
+
+	close(api.block)
+	<-flushed
+	assert.NilError(t, <-closed)
+	// Only one of them recorded the run
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs")), 1)
+}
+
+// Closing a run that was already closed, or flushing it afterwards, doesn't send it again or panic
+func TestClose_afterClose(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 2)
+
+	assert.NilError(t, rsm.Close(context.Background(), 0, workspace.Catalog{}))
+	requests := api.requestCount()
+	assert.Equal(t, requests, 4)
+
+	assert.NilError(t, rsm.Close(context.Background(), 0, workspace.Catalog{}))
+	rsm.Flush(rsm.RunSummary.Tasks)
+	assert.Equal(t, api.requestCount(), requests)
+}
+
+func TestFlush_whileClosing(t *testing.T) {
+	started := make(chan struct{}, 1)
+	api := &fakeSpacesAPI{
+		response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`),
+		block:    make(chan struct{}),
+		onRequest: func(request fakeSpacesRequest) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+		},
+	}
+	rsm := newTestMeta(api, 3)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- rsm.Close(context.Background(), 0, workspace.Catalog{})
+	}()
+	<-started
+
+	// Close is recording the run, so Flush waits for it rather than recording it again
+	flushed := make(chan struct{})
+	go func() {
+		rsm.Flush(rsm.RunSummary.Tasks[:1])
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		t.Fatal("Flush returned while Close was still recording the run")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(api.block)
+	<-flushed
+	assert.NilError(t, <-closed)
+
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs")), 1)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 3)
+	done := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(done), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(done[0].body, payload))
+	assert.Equal(t, payload.Status, spacesRunStatusCompleted)
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 2)
+
+	assert.NilError(t, rsm.CloseWithTimeout(context.Background(), time.Minute, 0, workspace.Catalog{}))
+	assert.Equal(t, api.requestCount(), 4)
+}
+
+func TestSendToSpace_waitsForAbort(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`), delay: 50 * time.Millisecond}
+	rsm := newTestMeta(api, 20)
+	rsm.spacesClient.concurrency = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	assert.NilError(t, rsm.sendToSpace(ctx))
+
+	// By the time sendToSpace returns, the run has been marked as cancelled
+	for _, err := range rsm.SpacesErrors() {
+		assert.Assert(t, !errors.Is(err, ErrRecordingAbandoned), err)
+	}
+	done := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(done), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(done[0].body, payload))
+	assert.Equal(t, payload.Status, spacesRunStatusCancelled)
+}
+
+func TestCloseWithTimeout_stuckRequest(t *testing.T) {
+	// block ignores cancellation, like a request that's stuck
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`), block: make(chan struct{})}
+	t.Cleanup(func() { close(api.block) })
+	rsm := newTestMeta(api, 2)
+
+	start := time.Now()
+	err := rsm.CloseWithTimeout(context.Background(), 50*time.Millisecond, 0, workspace.Catalog{})
+	assert.Assert(t, errors.Is(err, ErrCloseTimeout), err)
+	assert.Assert(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, api.requestCount(), 1)
+}
+
+func TestNewSpacesClient_createMaxAttempts(t *testing.T) {
+	c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesCreateMaxAttemptsEnvVar: "8"})
+	assert.Equal(t, c.createRetry.maxAttempts, 8)
+	assert.Equal(t, c.retry.maxAttempts, spacesMaxAttempts)
+
+	c = newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesCreateMaxAttemptsEnvVar: "0"})
+	assert.Equal(t, c.createRetry.maxAttempts, spacesCreateMaxAttempts)
+}
+
+func TestRecord_onRunCreated(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.mirrorSpaceIDs = []string{"org-space"}
+	var created [][]string
+	rsm.OnSpacesRunCreated(func(runID string, runURL string) {
+		created = append(created, []string{runID, runURL})
+	})
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.DeepEqual(t, created, [][]string{{"run-id", "https://vercel.com/run"}})
+}
+
+func TestRecord_onRunCreatedNotCalledOnFailure(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 100, err: &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}}
+	rsm := newTestMeta(api, 3)
+	called := false
+	rsm.OnSpacesRunCreated(func(runID string, runURL string) {
+		called = true
+	})
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, !called)
+}
+
+func TestRecord_existingRunID(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.existingRunID = "existing-run"
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs")), 0)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/existing-run/tasks")), 3)
+	// the run is shared with other invocations, so this one doesn't mark it as done
+	for _, request := range api.requests {
+		assert.Assert(t, request.method != http.MethodPatch, "%v %v", request.method, request.url)
+	}
+}
+
+func TestRecord_existingRunIDInterrupted(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{}`), delay: 10 * time.Millisecond}
+	rsm := newTestMeta(api, 20)
+	rsm.existingRunID = "existing-run"
+	rsm.spacesClient.concurrency = 1
+	rsm.spacesClient.heartbeatInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, _ = rsm.record(ctx)
+	// an interrupted invocation doesn't cancel the shared run, or keep it alive
+	for _, request := range api.requests {
+		assert.Assert(t, request.method != http.MethodPatch, "%v %v", request.method, request.url)
+	}
+}
+
+func TestRecord_finishExistingRun(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.existingRunID = "existing-run"
+	rsm.finishExistingRun = true
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	done := api.requestsTo("/v0/spaces/space-id/runs/existing-run")
+	assert.Equal(t, len(done), 1)
+	assert.Equal(t, done[0].method, http.MethodPatch)
+}
+
+func TestRecord_invalidExistingRunID(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 3)
+	rsm.existingRunID = "../runs"
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrInvalidRunID))
+	assert.Equal(t, api.requestCount(), 0)
+}
+
+// The run is only marked as done once every task summary has been sent
+func TestRecord_doneIsLast(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`), delay: time.Millisecond}
+	rsm := newTestMeta(api, 100)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, api.requestCount(), 102)
+	last := api.requests[len(api.requests)-1]
+	assert.Equal(t, last.method, http.MethodPatch)
+	assert.Equal(t, last.url, "/v0/spaces/space-id/runs/run-id")
+	assert.Assert(t, strings.Contains(string(last.body), `"status":"completed"`))
+}
+
+func TestSpacesClient_makeRequestPayloadTooLarge(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	c := newTestSpacesClient(api)
+	c.maxPayloadBytes = 16
+	c.failedRequestsPath = getSpacesFailedRequestsPath(turbopath.AbsoluteSystemPath(t.TempDir()))
+
+	_, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{"log":"far too much output"}`))
+	assert.Assert(t, errors.Is(err, ErrPayloadTooLarge))
+	assert.ErrorContains(t, err, "payload too large: 29 bytes is over the limit of 16 bytes")
+	assert.Equal(t, api.requestCount(), 0)
+	// Sending it again later wouldn't help
+	assert.Assert(t, !c.failedRequestsPath.FileExists())
+
+	_, err = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte(`{"log":"ok"}`))
+	assert.NilError(t, err)
+	assert.Equal(t, api.requestCount(), 1)
+}
+
+func TestNewSpacesClient_maxPayloadBytes(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 4 * 1024 * 1024},
+		{value: "1024", want: 1024},
+		{value: "0", want: 4 * 1024 * 1024},
+		{value: "big", want: 4 * 1024 * 1024},
+	}
+
+	for _, tc := range testCases {
+		c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesMaxPayloadBytesEnvVar: tc.value})
+		assert.Equal(t, c.maxPayloadBytes, tc.want, "value %q", tc.value)
+	}
+}
+
+func TestRecord_gzippedResponse(t *testing.T) {
+	var response bytes.Buffer
+	writer := gzip.NewWriter(&response)
+	_, err := writer.Write([]byte(`{"id":"run-id","url":"https://vercel.com/run"}`))
+	assert.NilError(t, err)
+	assert.NilError(t, writer.Close())
+
+	api := &fakeSpacesAPI{response: response.Bytes()}
+	rsm := newTestMeta(api, 2)
+
+	runURL, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, runURL, "https://vercel.com/run")
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 2)
+	for _, request := range api.requests {
+		assert.Equal(t, request.headers.Get("Accept-Encoding"), "gzip")
+	}
+}
+
+func TestSpacesClient_gzippedErrorResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+		writer := gzip.NewWriter(w)
+		_, _ = writer.Write([]byte(`{"error":"invalid task"}`))
+		_ = writer.Close()
+	}))
+	defer ts.Close()
+
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	rsm := newTestMeta(apiClient, 0)
+
+	_, err := rsm.spacesClient.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", []byte("{}"))
+	httpErr := &HTTPError{}
+	assert.Assert(t, errors.As(err, &httpErr))
+	assert.Equal(t, httpErr.StatusCode, http.StatusBadRequest)
+	statusErr := &client.StatusError{}
+	assert.Assert(t, errors.As(err, &statusErr))
+	assert.Equal(t, statusErr.Body, `{"error":"invalid task"}`)
+}
+
+func TestSpacesClient_makeRequestCompression(t *testing.T) {
+	small := []byte(`{"log":"ok"}`)
+	large := []byte(fmt.Sprintf(`{"log":%q}`, strings.Repeat("building...\n", 1000)))
+
+	api := &fakeSpacesAPI{}
+	c := newTestSpacesClient(api)
+	ctx := context.Background()
+
+	_, err := c.makeRequest(ctx, http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", small)
+	assert.NilError(t, err)
+	_, err = c.makeRequest(ctx, http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", large)
+	assert.NilError(t, err)
+	_, err = c.makeRequest(ctx, http.MethodPatch, "/v0/spaces/space-id/runs/run-id", large)
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(api.requests), 3)
+	assert.Equal(t, api.requests[0].headers.Get("Content-Encoding"), "")
+	assert.DeepEqual(t, api.requests[0].body, small)
+
+	assert.Equal(t, api.requests[1].headers.Get("Content-Encoding"), "gzip")
+	assert.Assert(t, len(api.requests[1].body) < len(large))
+	assert.DeepEqual(t, gunzip(t, api.requests[1].body), large)
+
+	// only POST bodies are compressed
+	assert.Equal(t, api.requests[2].headers.Get("Content-Encoding"), "")
+	assert.DeepEqual(t, api.requests[2].body, large)
+}
+
+func TestSpacesClient_makeRequestCustomHeaders(t *testing.T) {
+	received := make(chan http.Header, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		received <- req.Header
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	rsm := newTestMeta(apiClient, 0)
+	rsm.SetSpacesHeader("X-Proxy-Team", "my-team")
+
+	large := []byte(fmt.Sprintf(`{"log":%q}`, strings.Repeat("building...\n", 1000)))
+	_, err := rsm.spacesClient.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", large)
+	assert.NilError(t, err)
+	_, err = rsm.spacesClient.makeRequest(context.Background(), http.MethodPatch, "/v0/spaces/space-id/runs/run-id", []byte("{}"))
+	assert.NilError(t, err)
+
+	post := <-received
+	assert.Equal(t, post.Get("X-Proxy-Team"), "my-team")
+	assert.Equal(t, post.Get("Content-Encoding"), "gzip")
+	assert.Equal(t, post.Get("Authorization"), "Bearer my-token")
+	patch := <-received
+	assert.Equal(t, patch.Get("X-Proxy-Team"), "my-team")
+	assert.Equal(t, patch.Get("Content-Encoding"), "")
+}
+
+func TestSpacesClient_proxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		proxied <- req.URL.String()
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := getSpacesProxy(env.EnvironmentVariableMap{spacesProxyEnvVar: proxy.URL})
+	assert.NilError(t, err)
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: "http://api.example.com", Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	c := newTestSpacesClient(apiClient.WithTransport(newSpacesTransport(proxyURL, nil, 1)))
+
+	_, err = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte("{}"))
+	assert.NilError(t, err)
+	assert.Equal(t, <-proxied, "http://api.example.com/v0/spaces/space-id/runs?slug=my-team-slug")
+}
+
+func TestGetSpacesProxy(t *testing.T) {
+	proxyURL, err := getSpacesProxy(env.EnvironmentVariableMap{})
+	assert.NilError(t, err)
+	assert.Assert(t, proxyURL == nil)
+
+	_, err = getSpacesProxy(env.EnvironmentVariableMap{spacesProxyEnvVar: "not a url"})
+	assert.ErrorContains(t, err, "invalid TURBO_SPACES_PROXY")
+}
+
+func TestSpacesClient_customCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	// the server's certificate is self-signed, so it's its own CA
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NilError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644))
+
+	makeRequest := func(envVars env.EnvironmentVariableMap) error {
+		tlsConfig, err := getSpacesTLSConfig(envVars)
+		assert.NilError(t, err)
+		apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+		c := newTestSpacesClient(apiClient.WithTransport(newSpacesTransport(nil, tlsConfig, 1)))
+		c.retry.maxAttempts = 1
+		_, err = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte("{}"))
+		return err
+	}
+
+	assert.ErrorContains(t, makeRequest(env.EnvironmentVariableMap{}), "certificate")
+	assert.NilError(t, makeRequest(env.EnvironmentVariableMap{spacesCAFileEnvVar: caFile}))
+	assert.NilError(t, makeRequest(env.EnvironmentVariableMap{spacesInsecureSkipVerifyEnvVar: "true"}))
+}
+
+func TestGetSpacesTLSConfig(t *testing.T) {
+	tlsConfig, err := getSpacesTLSConfig(env.EnvironmentVariableMap{})
+	assert.NilError(t, err)
+	assert.Assert(t, tlsConfig == nil)
+
+	_, err = getSpacesTLSConfig(env.EnvironmentVariableMap{spacesCAFileEnvVar: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.ErrorContains(t, err, "invalid TURBO_SPACES_CA_FILE")
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NilError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0644))
+	_, err = getSpacesTLSConfig(env.EnvironmentVariableMap{spacesCAFileEnvVar: notPEM})
+	assert.ErrorContains(t, err, "no certificates found in "+notPEM)
+
+	tlsConfig, err = getSpacesTLSConfig(env.EnvironmentVariableMap{spacesInsecureSkipVerifyEnvVar: "true"})
+	assert.NilError(t, err)
+	assert.Assert(t, tlsConfig.InsecureSkipVerify)
+	assert.Assert(t, tlsConfig.RootCAs == nil)
+}
+
+// newConnCountingServer returns a server that counts the connections opened to it.
+// Each response takes a millisecond, so that requests from different workers overlap.
+func newConnCountingServer(conns *int64) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		_, _ = io.Copy(io.Discard, req.Body)
+		time.Sleep(time.Millisecond)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(conns, 1)
+		}
+	}
+	ts.Start()
+	return ts
+}
+
+// postConcurrently sends requests POSTs from the given number of workers. Each worker pauses
+// between requests, like it would while building the next task's payload.
+func postConcurrently(c *spacesClient, workers int, requests int) {
+	queue := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		queue <- i
+	}
+	close(queue)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range queue {
+				_, _ = c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", []byte("{}"))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNewSpacesTransport_reusesConnections(t *testing.T) {
+	var conns int64
+	ts := newConnCountingServer(&conns)
+	defer ts.Close()
+
+	workers := 8
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	c := newTestSpacesClient(apiClient.WithTransport(newSpacesTransport(nil, nil, workers)))
+
+	postConcurrently(c, workers, 200)
+	assert.Assert(t, atomic.LoadInt64(&conns) <= int64(workers), "opened %v connections for %v workers", conns, workers)
+}
+
+func BenchmarkSpacesTransport(b *testing.B) {
+	workers := 8
+	benchmarks := []struct {
+		name      string
+		transport func() http.RoundTripper
+	}{
+		{name: "default", transport: func() http.RoundTripper { return http.DefaultTransport.(*http.Transport).Clone() }},
+		{name: "spaces", transport: func() http.RoundTripper { return newSpacesTransport(nil, nil, workers) }},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			var conns int64
+			ts := newConnCountingServer(&conns)
+			defer ts.Close()
+			apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+			c := newTestSpacesClient(apiClient.WithTransport(bm.transport()))
+
+			b.ResetTimer()
+			postConcurrently(c, workers, b.N)
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestSpacesClient_makeRequestCompressionUnsupported(t *testing.T) {
+	large := []byte(fmt.Sprintf(`{"log":%q}`, strings.Repeat("building...\n", 1000)))
+
+	api := &fakeSpacesAPI{failures: 1, err: &client.StatusError{StatusCode: http.StatusUnsupportedMediaType}}
+	c := newTestSpacesClient(api)
+	ctx := context.Background()
+
+	_, err := c.makeRequest(ctx, http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", large)
+	assert.NilError(t, err)
+	_, err = c.makeRequest(ctx, http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", large)
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(api.requests), 3)
+	assert.Equal(t, api.requests[0].headers.Get("Content-Encoding"), "gzip")
+	for _, request := range api.requests[1:] {
+		assert.Equal(t, request.headers.Get("Content-Encoding"), "")
+		assert.DeepEqual(t, request.body, large)
+	}
+}
+
+func TestSpacesClient_makeRequestUnsupportedMethod(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	c := newSpacesClient(api, env.EnvironmentVariableMap{})
+
+	_, err := c.makeRequest(context.Background(), http.MethodGet, "/v0/spaces/space-id/runs", nil)
+	assert.ErrorContains(t, err, "unsupported request method")
+	assert.Equal(t, len(api.requests), 0)
+}
+
+func TestPostTaskSummaries_stopsOnCancel(t *testing.T) {
+	api := &fakeSpacesAPI{block: make(chan struct{})}
+	rsm := newTestMeta(api, 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan []error)
+	go func() {
+		done <- rsm.postTaskSummaries(ctx, "space-id", "run-id")
+	}()
+
+	// Wait for every worker to have a request in flight
+	for api.requestCount() < 8 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	close(api.block)
+
+	select {
+	case errs := <-done:
+		assert.Equal(t, len(errs), 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("postTaskSummaries did not return after the context was cancelled")
+	}
+	assert.Equal(t, api.requestCount(), 8)
+}
+
+func TestNewSpacesClient_taskBatchSize(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 0},
+		{value: "50", want: 50},
+		{value: "0", want: 0},
+		{value: "-1", want: 0},
+		{value: "lots", want: 0},
+	}
+
+	for _, tc := range testCases {
+		c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesTaskBatchSizeEnvVar: tc.value})
+		assert.Equal(t, c.taskBatchSize, tc.want, "value %q", tc.value)
+	}
+}
+
+func TestNewSpacesClient_concurrency(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 8},
+		{value: "2", want: 2},
+		{value: "0", want: 1},
+		{value: "-4", want: 1},
+		{value: "10000", want: 64},
+		{value: "many", want: 8},
+	}
+
+	for _, tc := range testCases {
+		c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesConcurrencyEnvVar: tc.value})
+		assert.Equal(t, c.concurrency, tc.want, "value %q", tc.value)
+	}
+}
+
+func TestNewSpacesClient_maxInFlight(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  int
+	}{
+		{value: "", want: 16},
+		{value: "4", want: 4},
+		{value: "0", want: 1},
+		{value: "-4", want: 1},
+		{value: "many", want: 16},
+	}
+
+	for _, tc := range testCases {
+		c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesMaxInFlightEnvVar: tc.value})
+		assert.Equal(t, cap(c.inFlight), tc.want, "value %q", tc.value)
+	}
+}
+
+// inFlightSpacesAPI records the largest number of requests it was sent at the same time
+type inFlightSpacesAPI struct {
+	*fakeSpacesAPI
+	current int64
+	peak    int64
+}
+
+func (f *inFlightSpacesAPI) track(send spacesSendFunc) spacesSendFunc {
+	return func(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+		current := atomic.AddInt64(&f.current, 1)
+		defer atomic.AddInt64(&f.current, -1)
+		for {
+			peak := atomic.LoadInt64(&f.peak)
+			if current <= peak || atomic.CompareAndSwapInt64(&f.peak, peak, current) {
+				break
+			}
+		}
+		return send(ctx, url, body, headers)
+	}
+}
+
+func (f *inFlightSpacesAPI) JSONPostWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	return f.track(f.fakeSpacesAPI.JSONPostWithHeaders)(ctx, url, body, headers)
+}
+
+func (f *inFlightSpacesAPI) JSONPatchWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	return f.track(f.fakeSpacesAPI.JSONPatchWithHeaders)(ctx, url, body, headers)
+}
+
+func (f *inFlightSpacesAPI) JSONPutWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	return f.track(f.fakeSpacesAPI.JSONPutWithHeaders)(ctx, url, body, headers)
+}
+
+func TestPostTaskSummaries_maxInFlight(t *testing.T) {
+	api := &inFlightSpacesAPI{fakeSpacesAPI: &fakeSpacesAPI{delay: 5 * time.Millisecond}}
+	rsm := newTestMeta(api.fakeSpacesAPI, 50)
+	rsm.spacesClient.api = api
+	rsm.spacesClient.concurrency = 16
+	rsm.spacesClient.inFlight = util.NewSemaphore(3)
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, api.requestCount(), 50)
+	assert.Equal(t, atomic.LoadInt64(&api.peak), int64(3))
+}
+
+func TestPostTaskSummaries_concurrency(t *testing.T) {
+	for _, concurrency := range []int{1, 3, 8} {
+		t.Run(fmt.Sprintf("%v workers", concurrency), func(t *testing.T) {
+			api := &fakeSpacesAPI{block: make(chan struct{})}
+			rsm := newTestMeta(api, 20)
+			rsm.spacesClient.concurrency = concurrency
+
+			done := make(chan []error)
+			go func() {
+				done <- rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+			}()
+
+			// Every worker picks up one task and blocks on it
+			for api.requestCount() < concurrency {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			assert.Equal(t, api.requestCount(), concurrency)
+
+			close(api.block)
+			select {
+			case errs := <-done:
+				assert.Equal(t, len(errs), 0)
+			case <-time.After(5 * time.Second):
+				t.Fatal("postTaskSummaries did not return")
+			}
+			assert.Equal(t, api.requestCount(), 20)
+		})
+	}
+}
+
+func TestPostTaskSummaries_batches(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 5)
+	rsm.spacesClient.taskBatchSize = 2
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 0)
+
+	batches := api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks/batch")
+	assert.Equal(t, api.requestCount(), 3)
+	assert.Equal(t, len(batches), 3)
+
+	var taskKeys [][]string
+	for _, batch := range batches {
+		tasks := []spacesTask{}
+		assert.NilError(t, json.Unmarshal(batch.body, &tasks))
+		keys := []string{}
+		for _, task := range tasks {
+			keys = append(keys, task.Key)
+		}
+		taskKeys = append(taskKeys, keys)
+	}
+	assert.DeepEqual(t, taskKeys, [][]string{
+		{"my-app#build-0", "my-app#build-1"},
+		{"my-app#build-2", "my-app#build-3"},
+		{"my-app#build-4"},
+	})
+}
+
+func TestPostTaskSummaries_batchFailure(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 1, err: &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}}
+	rsm := newTestMeta(api, 5)
+	rsm.spacesClient.taskBatchSize = 2
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 2)
+	assert.Equal(t, api.requestCount(), 3)
+}
+
+func TestPostTaskSummaries_batchEndpointNotFound(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 1, err: &client.StatusError{StatusCode: http.StatusNotFound, Body: "not found"}}
+	rsm := newTestMeta(api, 5)
+	rsm.spacesClient.taskBatchSize = 2
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks/batch")), 1)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 5)
+}
+
+func TestRecord_cancelledRunIsAborted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	api.onRequest = func(request fakeSpacesRequest) {
+		// Interrupt the run once it starts sending tasks
+		if strings.HasSuffix(request.url, "/tasks") {
+			cancel()
+		}
+	}
+	rsm := newTestMeta(api, 20)
+	rsm.RunSummary.ExecutionSummary.endedAt = time.Now()
+
+	rsm.record(ctx)
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 1)
+	assert.Equal(t, requests[0].method, http.MethodPatch)
+
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(requests[0].body, payload))
+	assert.Equal(t, payload.Status, "cancelled")
+	assert.Equal(t, payload.EndTime, rsm.RunSummary.ExecutionSummary.endedAt.UnixMilli())
+}
+
+func TestRecord_completedRun(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+
+	url, errs := rsm.record(context.Background())
+	assert.Equal(t, url, "https://vercel.com/run")
+	assert.Equal(t, len(errs), 0)
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(requests[0].body, payload))
+	assert.Equal(t, payload.Status, "completed")
+}
+
+// taskErrSpacesAPI responds to every task summary with taskErr
+type taskErrSpacesAPI struct {
+	*fakeSpacesAPI
+	taskErr error
+}
+
+func (f *taskErrSpacesAPI) JSONPostWithHeaders(ctx context.Context, url string, body []byte, headers http.Header) ([]byte, error) {
+	resp, err := f.fakeSpacesAPI.JSONPostWithHeaders(ctx, url, body, headers)
+	if strings.Contains(url, "/tasks") {
+		return nil, f.taskErr
+	}
+	return resp, err
+}
+
+func TestRecord_tasksEndpointNotFound(t *testing.T) {
+	// like a server that doesn't have the tasks endpoint
+	api := &taskErrSpacesAPI{
+		fakeSpacesAPI: &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)},
+		taskErr:       &client.StatusError{StatusCode: http.StatusNotFound, Body: "not found"},
+	}
+	rsm := newTestMeta(api, 20)
+	rsm.spacesClient.concurrency = 1
+	rsm.mirrorSpaceIDs = []string{"org-space"}
+
+	_, errs := rsm.record(context.Background())
+	// Reported once for each Space, so strict mode fails the run
+	assert.Equal(t, len(errs), 2)
+	assert.Assert(t, errors.Is(errs[0], ErrTasksUnsupported), errs[0])
+	assert.Assert(t, errors.Is(errs[1], ErrTasksUnsupported), errs[1])
+	targetErr := &spacesTargetError{}
+	assert.Assert(t, errors.As(errs[1], &targetErr))
+	assert.Equal(t, targetErr.spaceID, "org-space")
+
+	// Each Space is tried, however the one before it responded
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 1)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/org-space/runs/run-id/tasks")), 1)
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(requests[0].body, payload))
+	assert.Equal(t, payload.Status, "completed")
+}
+
+func TestRecord_existingRunNotFound(t *testing.T) {
+	api := &taskErrSpacesAPI{
+		fakeSpacesAPI: &fakeSpacesAPI{response: []byte(`{}`)},
+		taskErr:       &client.StatusError{StatusCode: http.StatusNotFound, Body: "not found"},
+	}
+	rsm := newTestMeta(api, 20)
+	rsm.spacesClient.concurrency = 1
+	rsm.existingRunID = "misspelled-run"
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrInvalidRunID), errs[0])
+	assert.ErrorContains(t, errs[0], "run misspelled-run wasn't found in Space space-id")
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/misspelled-run/tasks")), 1)
+}
+
+func TestRecord_skipCacheHits(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 4)
+	rsm.skipCacheHits = true
+	rsm.RunSummary.Tasks[0].CacheSummary.Status = cache.CacheEventHit
+	rsm.RunSummary.Tasks[2].CacheSummary.Status = cache.CacheEventHit
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	postedTaskIDs := []string{}
+	for _, request := range api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks") {
+		task := &spacesTask{}
+		assert.NilError(t, json.Unmarshal(request.body, task))
+		postedTaskIDs = append(postedTaskIDs, task.Key)
+	}
+	sort.Strings(postedTaskIDs)
+	assert.DeepEqual(t, postedTaskIDs, []string{"my-app#build-1", "my-app#build-3"})
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 1)
+	payload := &spacesRunPayload{}
+	assert.NilError(t, json.Unmarshal(requests[0].body, payload))
+	assert.Equal(t, payload.TotalTasks, 4)
+	assert.Equal(t, payload.SkippedTasks, 2)
+}
+
+// newTestRunMeta wraps runSummary in a Meta, to build the payloads for it
+func newTestRunMeta(runSummary *RunSummary) *Meta {
+	return &Meta{RunSummary: runSummary, spacesClient: newTestSpacesClient(&fakeSpacesAPI{})}
+}
+
+func TestNewSpacesDonePayload_clockSkew(t *testing.T) {
+	startedAt := time.UnixMilli(10000)
+	runSummary := &RunSummary{ExecutionSummary: &executionSummary{startedAt: startedAt, endedAt: startedAt.Add(-time.Second)}}
+	rsm := newTestRunMeta(runSummary)
+	var out bytes.Buffer
+	rsm.spacesClient.logger = hclog.New(&hclog.LoggerOptions{Output: &out})
+
+	payload := rsm.newSpacesDonePayload()
+	assert.Equal(t, payload.EndTime, int64(10000))
+	assert.Assert(t, strings.Contains(out.String(), "end time is before start time"), out.String())
+	assert.Assert(t, strings.Contains(out.String(), "name=run"), out.String())
+}
+
+func TestNewSpacesTaskPayload_clockSkew(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 1)
+	var out bytes.Buffer
+	rsm.spacesClient.logger = hclog.New(&hclog.LoggerOptions{Output: &out})
+	task := rsm.RunSummary.Tasks[0]
+	task.Execution.startAt = time.UnixMilli(10000)
+	task.Execution.Duration = -time.Second
+
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.Equal(t, payload.StartTime, int64(10000))
+	assert.Equal(t, payload.EndTime, int64(10000))
+	assert.Assert(t, strings.Contains(out.String(), `name="my-app#build-0"`), out.String())
+
+	// times in order are sent as they are
+	out.Reset()
+	task.Execution.Duration = time.Second
+	payload = rsm.newSpacesTaskPayload(task)
+	assert.Equal(t, payload.EndTime, int64(11000))
+	assert.Equal(t, out.String(), "")
+}
+
+func TestNewSpacesDonePayload_taskCounts(t *testing.T) {
+	runSummary := &RunSummary{
+		ExecutionSummary: &executionSummary{
+			success:   3,
+			failure:   1,
+			cached:    4,
+			attempted: 8,
+			endedAt:   time.Now(),
+			exitCode:  1,
+		},
+	}
+	for i := 0; i < 10; i++ {
+		runSummary.Tasks = append(runSummary.Tasks, newTestTaskSummary(fmt.Sprintf("my-app#build-%d", i)))
+	}
+
+	payload := newTestRunMeta(runSummary).newSpacesDonePayload()
+	assert.Equal(t, payload.TotalTasks, 10)
+	assert.Equal(t, payload.CachedTasks, 4)
+	assert.Equal(t, payload.ExecutedTasks, 3)
+	assert.Equal(t, payload.FailedTasks, 1)
+	assert.Equal(t, payload.ExitCode, 1)
+}
+
+func TestNewSpacesDonePayload_hasFailures(t *testing.T) {
+	runSummary := &RunSummary{ExecutionSummary: &executionSummary{endedAt: time.Now(), exitCode: 0}}
+	for i := 0; i < 3; i++ {
+		runSummary.Tasks = append(runSummary.Tasks, newTestTaskSummary(fmt.Sprintf("my-app#build-%d", i)))
+	}
+	// a task that never ran, e.g. in a dry run
+	runSummary.Tasks = append(runSummary.Tasks, &TaskSummary{TaskID: "my-app#lint"})
+
+	payload := newTestRunMeta(runSummary).newSpacesDonePayload()
+	assert.Equal(t, payload.HasFailures, false)
+
+	// a non-critical task failed, but the run still exited with 0
+	exitCode := 1
+	runSummary.Tasks[1].Execution.exitCode = &exitCode
+	payload = newTestRunMeta(runSummary).newSpacesDonePayload()
+	assert.Equal(t, payload.ExitCode, 0)
+	assert.Equal(t, payload.Result, "success")
+	assert.Equal(t, payload.HasFailures, true)
+}
+
+func TestNewSpacesDonePayload_result(t *testing.T) {
+	testCases := []struct {
+		name        string
+		exitCode    int
+		interrupted bool
+		want        string
+	}{
+		{name: "exit 0", exitCode: 0, want: "success"},
+		{name: "non-zero exit", exitCode: 1, want: "failed"},
+		{name: "interrupted", exitCode: 130, interrupted: true, want: "cancelled"},
+		{name: "interrupted before failing", exitCode: 0, interrupted: true, want: "cancelled"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			runSummary := &RunSummary{ExecutionSummary: &executionSummary{endedAt: time.Now(), exitCode: tc.exitCode}}
+
+			payload := newTestRunMeta(runSummary).newSpacesDonePayload()
+			if tc.interrupted {
+				payload = newTestRunMeta(runSummary).newSpacesCancelledPayload()
+			}
+			assert.Equal(t, payload.Result, tc.want)
+		})
+	}
+}
+
+func TestNewSpacesDonePayload_timeSaved(t *testing.T) {
+	runSummary := &RunSummary{ExecutionSummary: &executionSummary{endedAt: time.Now()}}
+	for i, cacheSummary := range []TaskCacheSummary{
+		{Status: cache.CacheEventHit, Source: cache.CacheSourceFS, TimeSaved: 1200},
+		{Status: cache.CacheEventMiss},
+		{Status: cache.CacheEventHit, Source: cache.CacheSourceRemote, TimeSaved: 300},
+		{Status: cache.CacheEventHit, Source: cache.CacheSourceFS, TimeSaved: 45},
+	} {
+		task := newTestTaskSummary(fmt.Sprintf("my-app#build-%d", i))
+		task.CacheSummary = cacheSummary
+		runSummary.Tasks = append(runSummary.Tasks, task)
+	}
+
+	payload := newTestRunMeta(runSummary).newSpacesDonePayload()
+	assert.Equal(t, payload.TotalTimeSaved, 1545)
+}
+
+func TestPostTaskSummaries_onTaskPosted(t *testing.T) {
+	testCases := []struct {
+		name      string
+		batchSize int
+	}{
+		{name: "individual", batchSize: 0},
+		{name: "batched", batchSize: 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the first request fails, so one task (or one batch) is never posted
+			api := &fakeSpacesAPI{failures: 1, err: &client.StatusError{StatusCode: http.StatusBadRequest}}
+			rsm := newTestMeta(api, 20)
+			rsm.spacesClient.taskBatchSize = tc.batchSize
+
+			mu := sync.Mutex{}
+			calls := 0
+			maxPosted := 0
+			rsm.OnSpacesTaskPosted(func(posted int, total int) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				if posted > maxPosted {
+					maxPosted = posted
+				}
+				assert.Equal(t, total, 20)
+			})
+
+			errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+			assert.Equal(t, calls, 20-len(errs))
+			assert.Equal(t, maxPosted, calls)
+			assert.Equal(t, rsm.spacesClient.postedTasks("space-id"), calls)
+		})
+	}
+}
+
+func TestRecord_onTaskPostedPerSpace(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.mirrorSpaceIDs = []string{"org-space"}
+
+	mu := sync.Mutex{}
+	maxPosted := 0
+	rsm.OnSpacesTaskPosted(func(posted int, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if posted > maxPosted {
+			maxPosted = posted
+		}
+		assert.Assert(t, posted <= total, "posted %v of %v", posted, total)
+	})
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/org-space/runs/run-id/tasks")), 3)
+	assert.Equal(t, maxPosted, 3)
+}
+
+func BenchmarkPostTaskSummaries_2000(b *testing.B) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 2000)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsm.postTaskSummaries(ctx, "space-id", "run-id")
+	}
+}
+
+func TestPrintSpacesErrors(t *testing.T) {
+	ui := cli.NewMockUi()
+	timeout := errors.New("timeout")
+	errs := []error{
+		&spacesTaskError{taskID: "my-app#build", err: timeout},
+		fmt.Errorf("PATCH /v0/spaces/space-id/runs/run-id: %w", errors.New("bad request")),
+		&spacesTaskError{taskID: "my-app#test", err: timeout},
+		&spacesTaskError{taskID: "my-lib#build", err: &client.StatusError{StatusCode: 413, Body: "too large"}},
+	}
+
+	printSpacesErrors(ui, errs, 120, "trace-id")
+
+	assert.Equal(t, ui.ErrorWriter.String(), `Errors recording run to Spaces
+Failed to record run: PATCH /v0/spaces/space-id/runs/run-id: bad request
+3 of 120 task updates failed to reach Spaces
+  timeout (2 tasks)
+  too large
+Trace ID: trace-id
+`)
+}
+
+func TestPrintSpacesErrors_mirrors(t *testing.T) {
+	ui := cli.NewMockUi()
+	timeout := errors.New("timeout")
+	errs := []error{
+		&spacesTaskError{taskID: "my-app#build", err: timeout},
+		&spacesTargetError{spaceID: "org-space", err: &spacesTaskError{taskID: "my-app#build", err: timeout}},
+		&spacesTargetError{spaceID: "org-space", err: errors.New("PATCH /v0/spaces/org-space/runs/run-id: bad request")},
+	}
+
+	printSpacesErrors(ui, errs, 4, "trace-id")
+
+	assert.Equal(t, ui.ErrorWriter.String(), `Errors recording run to Spaces
+Failed to record run: space org-space: PATCH /v0/spaces/org-space/runs/run-id: bad request
+2 of 4 task updates failed to reach Spaces
+  timeout
+  space org-space: timeout
+Trace ID: trace-id
+`)
+}
+
+func TestPrintSpacesErrors_noErrors(t *testing.T) {
+	ui := cli.NewMockUi()
+	printSpacesErrors(ui, nil, 120, "trace-id")
+	assert.Equal(t, ui.ErrorWriter.String(), "")
+}
+
+// Run with -race to check that workers record errors safely
+func TestPostTaskSummaries_concurrentErrors(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 500, err: &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}}
+	rsm := newTestMeta(api, 500)
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 500)
+	assert.Equal(t, api.requestCount(), 500)
+}
+
+func TestRecord_dryRun(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	ui := cli.NewMockUi()
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.dryRun = true
+	rsm.spacesClient.ui = ui
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, api.requestCount(), 0)
+
+	output := ui.OutputWriter.String()
+	assert.Assert(t, strings.Contains(output, "POST /v0/spaces/space-id/runs\n{\n"))
+	assert.Equal(t, strings.Count(output, "POST /v0/spaces/space-id/runs/dry-run/tasks\n"), 3)
+	assert.Assert(t, strings.Contains(output, "PATCH /v0/spaces/space-id/runs/dry-run\n"))
+	assert.Assert(t, strings.Contains(output, `"status": "completed"`))
+}
+
+// fakeClock lets tests control the time seen by the Spaces client. Waiting on
+// After moves the clock forward and returns right away, and tests decide when
+// a ticker ticks by sending on ticks.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	ticks   chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.UnixMilli(0), ticks: make(chan time.Time)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- f.Now()
+	return ch
+}
+
+func (f *fakeClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	return f.ticks, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.stopped = true
+	}
+}
+
+func TestClose_spacesDisabled(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient = newSpacesClient(api, env.EnvironmentVariableMap{spacesDisableEnvVar: "1"})
+
+	assert.NilError(t, rsm.CloseWithError(context.Background(), 0, workspace.Catalog{}))
+	assert.Equal(t, api.requestCount(), 0)
+}
+
+func TestMakeRequest_retryAfter(t *testing.T) {
+	start := time.UnixMilli(0)
+	testCases := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{name: "seconds", retryAfter: "2", want: 2 * time.Second},
+		{name: "date", retryAfter: start.Add(3 * time.Second).UTC().Format(http.TimeFormat), want: 3 * time.Second},
+		{name: "past date", retryAfter: start.Add(-time.Minute).UTC().Format(http.TimeFormat), want: 0},
+		{name: "capped", retryAfter: "600", want: spacesMaxRetryAfter},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &fakeSpacesAPI{
+				failures: 1,
+				err: &client.StatusError{
+					StatusCode: http.StatusTooManyRequests,
+					Header:     http.Header{"Retry-After": []string{tc.retryAfter}},
+				},
+				response: []byte(`{"id":"run-id"}`),
+			}
+			clock := newFakeClock()
+			c := newTestSpacesClient(api)
+			c.clock = clock
+
+			resp, err := c.makeRequest(context.Background(), http.MethodPost, "/v0/spaces/space-id/runs", []byte("{}"))
+			assert.NilError(t, err)
+			assert.Equal(t, string(resp), `{"id":"run-id"}`)
+			assert.Equal(t, api.requestCount(), 2)
+			assert.Equal(t, clock.Now().Sub(start), tc.want)
+		})
+	}
+}
+
+func TestNewSpacesClient_heartbeatInterval(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "30", want: 30 * time.Second},
+		{value: "0", want: 0},
+		{value: "-5", want: 0},
+		{value: "often", want: 0},
+	}
+
+	for _, tc := range testCases {
+		c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesHeartbeatIntervalEnvVar: tc.value})
+		assert.Equal(t, c.heartbeatInterval, tc.want, "value %q", tc.value)
+	}
+}
+
+func TestNewSpacesClient_startJitter(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "500", want: 500 * time.Millisecond},
+		{value: "0", want: 0},
+		{value: "-5", want: 0},
+		{value: "soon", want: 0},
+	}
+
+	for _, tc := range testCases {
+		c := newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesStartJitterEnvVar: tc.value})
+		assert.Equal(t, c.startJitter, tc.want, "value %q", tc.value)
+	}
+}
+
+func TestRecord_startJitter(t *testing.T) {
+	delays := map[time.Duration]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		clock := newFakeClock()
+		api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+		rsm := newTestMeta(api, 0)
+		rsm.spacesClient.clock = clock
+		rsm.spacesClient.startJitter = time.Second
+		rsm.spacesClient.jitterRand = rand.New(rand.NewSource(seed))
+
+		_, errs := rsm.record(context.Background())
+		assert.Equal(t, len(errs), 0)
+		delay := clock.Now().Sub(time.UnixMilli(0))
+		assert.Assert(t, delay >= 0 && delay <= time.Second, "delay %v", delay)
+		delays[delay] = true
+	}
+	assert.Assert(t, len(delays) > 1, "the delay should vary between runs")
+}
+
+func TestSpacesClient_heartbeat(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	clock := newFakeClock()
+	c := newTestSpacesClient(api)
+	c.heartbeatInterval = time.Minute
+	c.clock = clock
+
+	stop := c.startHeartbeat(context.Background(), "/v0/spaces/space-id/runs/run-id")
+	first := time.UnixMilli(1000)
+	second := time.UnixMilli(2000)
+	clock.ticks <- first
+	clock.ticks <- second
+	stop()
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 2)
+	for i, want := range []time.Time{first, second} {
+		assert.Equal(t, requests[i].method, http.MethodPatch)
+		payload := &spacesRunPayload{}
+		assert.NilError(t, json.Unmarshal(requests[i].body, payload))
+		assert.Equal(t, payload.Status, "running")
+		assert.Equal(t, payload.UpdatedTime, want.UnixMilli())
+	}
+	assert.Assert(t, clock.stopped)
+}
+
+func TestSpacesClient_heartbeatDisabled(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	clock := newFakeClock()
+	c := newTestSpacesClient(api)
+	c.clock = clock
+
+	stop := c.startHeartbeat(context.Background(), "/v0/spaces/space-id/runs/run-id")
+	stop()
+	assert.Equal(t, api.requestCount(), 0)
+	assert.Assert(t, !clock.stopped, "heartbeats should be off by default")
+}
+
+func TestRecord_heartbeatStopsBeforeDone(t *testing.T) {
+	clock := newFakeClock()
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	api.onRequest = func(request fakeSpacesRequest) {
+		// Every task takes long enough for a heartbeat to be due
+		if strings.HasSuffix(request.url, "/tasks") {
+			clock.ticks <- time.Now()
+		}
+	}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.heartbeatInterval = time.Minute
+	rsm.spacesClient.clock = clock
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(requests), 4)
+	for i, request := range requests {
+		payload := &spacesRunPayload{}
+		assert.NilError(t, json.Unmarshal(request.body, payload))
+		if i < 3 {
+			assert.Equal(t, payload.Status, "running")
+		} else {
+			assert.Equal(t, payload.Status, "completed")
+		}
+	}
+	assert.Assert(t, clock.stopped)
+}
+
+func TestRecord_httpError(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 100, err: &client.StatusError{StatusCode: http.StatusServiceUnavailable, Body: "unavailable"}}
+	rsm := newTestMeta(api, 3)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+
+	httpErr := &HTTPError{}
+	assert.Assert(t, errors.As(errs[0], &httpErr))
+	assert.Equal(t, httpErr.StatusCode, http.StatusServiceUnavailable)
+	assert.Equal(t, httpErr.Method, http.MethodPost)
+	assert.Equal(t, httpErr.Endpoint, "/v0/spaces/space-id/runs")
+	assert.ErrorContains(t, errs[0], "unavailable")
+}
+
+// A missing Space ID is reported once for the run, not once per task
+func TestRecord_noSpaceID(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 1000)
+	rsm.spaceID = ""
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrNoSpaceID))
+	assert.Equal(t, api.requestCount(), 0)
+}
+
+func TestSendToSpace_notLinked(t *testing.T) {
+	api := &fakeSpacesAPI{unlinked: true}
+	rsm := newTestMeta(api, 1000)
+	ui := cli.NewMockUi()
+	rsm.ui = ui
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+	errs := rsm.SpacesErrors()
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrNotLinked))
+	assert.Equal(t, api.requestCount(), 0)
+	assert.Equal(t, ui.ErrorWriter.String(), "Runs are configured to be recorded to Space space-id, but this repo is not linked to Spaces. Run `turbo link --target=spaces` first.\n")
+}
+
+func TestSpacesErrors_copy(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 100, err: &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}}
+	rsm := newTestMeta(api, 1)
+	assert.Equal(t, len(rsm.SpacesErrors()), 0)
+
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+	errs := rsm.SpacesErrors()
+	assert.Equal(t, len(errs), 1)
+	assert.ErrorContains(t, errs[0], "POST /v0/spaces/space-id/runs")
+
+	// changing the returned slice doesn't change the recorded errors
+	errs[0] = nil
+	recorded := rsm.SpacesErrors()
+	assert.Equal(t, len(recorded), 1)
+	assert.ErrorContains(t, recorded[0], "POST /v0/spaces/space-id/runs")
+}
+
+func TestSpacesErrors_concurrent(t *testing.T) {
+	api := &fakeSpacesAPI{failures: 100, err: &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}}
+	rsm := newTestMeta(api, 10)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = rsm.SpacesErrors()
+		}
+	}()
+	assert.NilError(t, rsm.sendToSpace(context.Background()))
+	<-done
+	assert.Equal(t, len(rsm.SpacesErrors()), 1)
+}
+
+// Whether the repo is linked is only checked once, when the client is created
+func TestNewSpacesClient_linked(t *testing.T) {
+	api := &fakeSpacesAPI{unlinked: true}
+	c := newSpacesClient(api, env.EnvironmentVariableMap{})
+	assert.Assert(t, !c.linked)
+
+	api.unlinked = false
+	assert.Assert(t, !c.linked)
+	assert.Assert(t, newSpacesClient(api, env.EnvironmentVariableMap{}).linked)
+}
+
+func TestRecord_traceID(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	// compressed bodies have their own headers, make sure those keep the trace ID too
+	rsm.spacesClient.compressThreshold = 1
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	traceID := rsm.spacesClient.traceID
+	assert.Assert(t, traceID != "")
+	assert.Equal(t, api.requestCount(), 5)
+	for _, request := range api.requests {
+		assert.Equal(t, request.headers.Get("X-Turbo-Run-Trace"), traceID, "%v %v", request.method, request.url)
+	}
+
+	other := newSpacesClient(api, env.EnvironmentVariableMap{})
+	assert.Assert(t, other.traceID != traceID)
+}
+
+func TestPrintSpacesErrors_runErrorOnly(t *testing.T) {
+	ui := cli.NewMockUi()
+	printSpacesErrors(ui, []error{ErrNotLinked}, 3, "trace-id")
+	assert.Equal(t, ui.ErrorWriter.String(), `Errors recording run to Spaces
+Failed to record run: repo is not linked to a Space
+Trace ID: trace-id
+`)
+}
+
+func TestValidateSpaceID(t *testing.T) {
+	testCases := []struct {
+		spaceID string
+		wantErr error
+	}{
+		{spaceID: "space-id", wantErr: nil},
+		{spaceID: "space_3X9aBc2", wantErr: nil},
+		{spaceID: "", wantErr: ErrNoSpaceID},
+		{spaceID: "space id", wantErr: ErrInvalidSpaceID},
+		{spaceID: "my-team/space-id", wantErr: ErrInvalidSpaceID},
+		{spaceID: "space-id?team=x", wantErr: ErrInvalidSpaceID},
+		{spaceID: " space-id\n", wantErr: ErrInvalidSpaceID},
+		{spaceID: "https://vercel.com/my-team/spaces/space-id", wantErr: ErrInvalidSpaceID},
+		{spaceID: strings.Repeat("a", 129), wantErr: ErrInvalidSpaceID},
+	}
+
+	for _, tc := range testCases {
+		err := validateSpaceID(tc.spaceID)
+		if tc.wantErr == nil {
+			assert.NilError(t, err, "spaceID %q", tc.spaceID)
+		} else {
+			assert.Assert(t, errors.Is(err, tc.wantErr), "spaceID %q: got %v", tc.spaceID, err)
+		}
+	}
+}
+
+func TestRecord_invalidSpaceID(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 100)
+	rsm.spaceID = "my-team/space-id"
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrInvalidSpaceID))
+	assert.Equal(t, api.requestCount(), 0)
+}
+
+func TestRecord_printsRunURL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{name: "url", response: `{"id":"run-id","url":"https://vercel.com/run"}`, want: "Run: https://vercel.com/run\n\n"},
+		{name: "no url", response: `{"id":"run-id"}`, want: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ui := cli.NewMockUi()
+			api := &fakeSpacesAPI{response: []byte(tc.response)}
+			var outputBeforeTasks string
+			api.onRequest = func(request fakeSpacesRequest) {
+				if strings.HasSuffix(request.url, "/tasks") && outputBeforeTasks == "" {
+					outputBeforeTasks = ui.OutputWriter.String()
+				}
+			}
+			rsm := newTestMeta(api, 1)
+			rsm.ui = ui
+
+			_, errs := rsm.record(context.Background())
+			assert.Equal(t, len(errs), 0)
+			// the url is shown before any tasks are sent
+			assert.Equal(t, outputBeforeTasks, tc.want)
+			assert.Equal(t, ui.OutputWriter.String(), tc.want)
+		})
+	}
+}
+
+// The create request is bounded by the request timeout, so a create that never
+// finishes can't hang the run. Task summaries are skipped since there's no run to add them to.
+func TestRecord_createNeverFinishes(t *testing.T) {
+	api := &fakeSpacesAPI{delay: time.Hour}
+	rsm := newTestMeta(api, 10)
+	rsm.spacesClient.requestTimeout = 10 * time.Millisecond
+	rsm.spacesClient.createRetry.maxAttempts = 1
+
+	url, errs := rsm.record(context.Background())
+	assert.Equal(t, url, "")
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], context.DeadlineExceeded))
+	assert.Equal(t, api.requestCount(), 1)
+}
+
+func TestNewSpacesTaskPayload_attempts(t *testing.T) {
+	es := newExecutionSummary("turbo run build", "", time.Now(), "")
+	tracer, execution := es.run("my-app#build")
+
+	failed := 1
+	succeeded := 0
+	tracer(TargetBuilding, nil, nil)
+	tracer(TargetBuildFailed, errors.New("flaky"), &failed)
+	tracer(TargetBuilding, nil, nil)
+	tracer(TargetBuilt, nil, &succeeded)
+
+	task := newTestTaskSummary("my-app#build")
+	task.Execution = execution
+	task.CacheSummary = TaskCacheSummary{Status: "MISS"}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.Equal(t, payload.Attempts, 2)
+	assert.Equal(t, payload.ExitCode, 0)
+
+	body, err := json.Marshal(payload)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(body), `"attempts":2`))
+}
+
+func TestNewSpacesTaskPayload_queuedTime(t *testing.T) {
+	runStart := time.UnixMilli(1000)
+	testCases := []struct {
+		name      string
+		taskStart time.Time
+		want      int64
+	}{
+		{name: "starts after the run", taskStart: runStart.Add(1500 * time.Millisecond), want: 1500},
+		{name: "starts with the run", taskStart: runStart, want: 0},
+		{name: "clock skew", taskStart: runStart.Add(-time.Second), want: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+			rsm.RunSummary.ExecutionSummary.startedAt = runStart
+			task := newTestTaskSummary("my-app#build")
+			task.Execution.startAt = tc.taskStart
+
+			assert.Equal(t, rsm.newSpacesTaskPayload(task).QueuedTime, tc.want)
+		})
+	}
+}
+
+func TestNewSpacesTaskPayload_sortsDependencies(t *testing.T) {
+	task := newTestTaskSummary("my-app#build")
+	task.Dependencies = []string{"my-lib#build", "config#build", "ui#build"}
+	task.Dependents = []string{"my-app#test", "my-app#lint"}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.DeepEqual(t, payload.Dependencies, []string{"config#build", "my-lib#build", "ui#build"})
+	assert.DeepEqual(t, payload.Dependents, []string{"my-app#lint", "my-app#test"})
+
+	// The task summary itself is left alone
+	assert.DeepEqual(t, task.Dependencies, []string{"my-lib#build", "config#build", "ui#build"})
+}
+
+func TestNewSpacesTaskPayload_noExitCode(t *testing.T) {
+	task := newTestTaskSummary("my-app#build")
+	task.Execution.exitCode = nil
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.Equal(t, payload.ExitCode, -1)
+
+	body, err := json.Marshal(payload)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(body), `"exitCode":-1`))
+}
+
+func TestNewSpacesGraphPayload(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	web := newTestTaskSummary("web#build")
+	web.Dependencies = []string{"ui#build", "config#build"}
+	ui := newTestTaskSummary("ui#build")
+	ui.Dependencies = []string{"config#build"}
+	// config#build isn't in the run's tasks, because the config workspace has no build script
+	rsm.RunSummary.Tasks = []*TaskSummary{web, ui, newTestTaskSummary("docs#build")}
+
+	graph := rsm.newSpacesGraphPayload()
+	assert.DeepEqual(t, graph.Nodes, []string{"config#build", "docs#build", "ui#build", "web#build"})
+	assert.DeepEqual(t, graph.Edges, []spacesGraphEdge{
+		{Task: "ui#build", DependsOn: "config#build"},
+		{Task: "web#build", DependsOn: "config#build"},
+		{Task: "web#build", DependsOn: "ui#build"},
+	})
+
+	body, err := rsm.marshalSpacesPayload(spacesGraphKind, graph)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), `{"schemaVersion":"1","nodes":["config#build","docs#build","ui#build","web#build"],`+
+		`"edges":[{"task":"ui#build","dependsOn":"config#build"},{"task":"web#build","dependsOn":"config#build"},{"task":"web#build","dependsOn":"ui#build"}]}`)
+}
+
+func TestRecord_graph(t *testing.T) {
+	for _, sendGraph := range []bool{true, false} {
+		api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+		rsm := newTestMeta(api, 2)
+		rsm.sendGraph = sendGraph
+
+		_, errs := rsm.record(context.Background())
+		assert.Equal(t, len(errs), 0)
+		graphRequests := api.requestsTo("/v0/spaces/space-id/runs/run-id/graph")
+		if !sendGraph {
+			assert.Equal(t, len(graphRequests), 0)
+			continue
+		}
+		assert.Equal(t, len(graphRequests), 1)
+		assert.Equal(t, graphRequests[0].method, http.MethodPost)
+		// the graph is sent once the run is created, before any of its tasks
+		assert.Equal(t, api.requests[1].url, "/v0/spaces/space-id/runs/run-id/graph")
+	}
+}
+
+func TestRecord_summary(t *testing.T) {
+	for _, sendSummary := range []bool{true, false} {
+		api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+		rsm := newTestMeta(api, 2)
+		rsm.RunSummary.GlobalHashSummary = &GlobalHashSummary{}
+		rsm.spacesClient.compressThreshold = 100
+		rsm.sendSummary = sendSummary
+
+		_, errs := rsm.record(context.Background())
+		assert.Equal(t, len(errs), 0)
+		summaryRequests := api.requestsTo("/v0/spaces/space-id/runs/run-id/summary")
+		if !sendSummary {
+			assert.Equal(t, len(summaryRequests), 0)
+			continue
+		}
+		assert.Equal(t, len(summaryRequests), 1)
+
+		// the summary is large, so it's compressed like any other request
+		request := summaryRequests[0]
+		assert.Equal(t, request.method, http.MethodPost)
+		assert.Equal(t, request.headers.Get("Content-Encoding"), "gzip")
+		want, err := rsm.FormatJSON()
+		assert.NilError(t, err)
+		assert.Equal(t, string(gunzip(t, request.body)), string(want))
+
+		// it's sent after the tasks, and the run is still marked as done last
+		assert.Equal(t, api.requests[3].url, "/v0/spaces/space-id/runs/run-id/summary")
+		assert.Equal(t, api.requests[4].url, "/v0/spaces/space-id/runs/run-id")
+	}
+}
+
+func TestNewSpacesTaskPayload_tags(t *testing.T) {
+	task := newTestTaskSummary("my-app#dev")
+	task.Framework = "nextjs"
+	task.ResolvedTaskDefinition = &fs.TaskDefinition{Persistent: true}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.DeepEqual(t, payload.Tags, map[string]string{"framework": "nextjs", "persistent": "true"})
+
+	// A task without any tags leaves them out
+	body, err := json.Marshal(rsm.newSpacesTaskPayload(newTestTaskSummary("my-app#build")))
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), `"tags"`))
+}
+
+func TestNewSpacesTaskPayload_hashInputs(t *testing.T) {
+	task := newTestTaskSummary("my-app#build")
+	task.ExpandedInputs = map[turbopath.AnchoredUnixPath]string{"src/index.ts": "abc123"}
+	task.ExternalDepsHash = "def456"
+	task.Command = "next build"
+	task.EnvVars = TaskEnvVarSummary{Configured: []string{"API_URL=789abc"}}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.Assert(t, payload.HashInputs == nil)
+	body, err := json.Marshal(payload)
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), "hashInputs"))
+
+	rsm.sendHashInputs = true
+	payload = rsm.newSpacesTaskPayload(task)
+	assert.Assert(t, payload.HashInputs != nil)
+	assert.DeepEqual(t, payload.HashInputs.Inputs, task.ExpandedInputs)
+	assert.Equal(t, payload.HashInputs.ExternalDepsHash, "def456")
+	assert.Equal(t, payload.HashInputs.Command, "next build")
+	assert.DeepEqual(t, payload.HashInputs.EnvVars.Configured, []string{"API_URL=789abc"})
+}
+
+func TestNewSpacesTaskPayload_envVarKeys(t *testing.T) {
+	task := newTestTaskSummary("my-app#build")
+	task.EnvVars = TaskEnvVarSummary{
+		Configured:  []string{"NODE_ENV=abc123", "API_URL=def456"},
+		Inferred:    []string{"NEXT_PUBLIC_KEY=789abc", "API_URL=def456"},
+		Global:      []string{"VERCEL_ENV=fed321"},
+		Passthrough: []string{"AWS_SECRET_ACCESS_KEY=654cba"},
+	}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	body, err := json.Marshal(rsm.newSpacesTaskPayload(task))
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), "envVarKeys"), string(body))
+
+	rsm.sendHashInputs = true
+	payload := rsm.newSpacesTaskPayload(task)
+	assert.DeepEqual(t, payload.EnvVarKeys, []string{"API_URL", "NEXT_PUBLIC_KEY", "NODE_ENV", "VERCEL_ENV"})
+	for _, key := range payload.EnvVarKeys {
+		assert.Assert(t, !strings.Contains(key, "="), key)
+	}
+
+	task.EnvVars = TaskEnvVarSummary{}
+	body, err = json.Marshal(rsm.newSpacesTaskPayload(task))
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), "envVarKeys"), string(body))
+}
+
+func TestSendRunSummary(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	ui := cli.NewMockUi()
+	rsm.ui = ui
+
+	assert.NilError(t, SendRunSummary(context.Background(), rsm))
+
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs")), 1)
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 3)
+	done := api.requestsTo("/v0/spaces/space-id/runs/run-id")
+	assert.Equal(t, len(done), 1)
+	assert.Equal(t, done[0].method, http.MethodPatch)
+	assert.Assert(t, strings.Contains(ui.OutputWriter.String(), "Run: https://vercel.com/run"))
+	assert.Equal(t, ui.ErrorWriter.String(), "")
+}
+
+func TestSendRunSummary_errors(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	// the create succeeds and the first two tasks fail
+	api.onRequest = func(request fakeSpacesRequest) {
+		if request.method == http.MethodPost && request.url == "/v0/spaces/space-id/runs" {
+			api.mu.Lock()
+			api.failures = 3
+			api.mu.Unlock()
+		}
+	}
+	api.err = &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.concurrency = 1
+
+	err := SendRunSummary(context.Background(), rsm)
+	assert.ErrorContains(t, err, "2 errors occurred")
+	httpErr := &HTTPError{}
+	assert.Assert(t, errors.As(err, &httpErr))
+	assert.Equal(t, httpErr.StatusCode, http.StatusBadRequest)
+}
+
+func TestCloseWithError(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	// the create succeeds and every task fails
+	api.onRequest = func(request fakeSpacesRequest) {
+		if request.method == http.MethodPost && request.url == "/v0/spaces/space-id/runs" {
+			api.mu.Lock()
+			api.failures = 4
+			api.mu.Unlock()
+		}
+	}
+	api.err = &client.StatusError{StatusCode: http.StatusBadRequest, Body: "bad request"}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.concurrency = 1
+
+	err := rsm.CloseWithError(context.Background(), 0, workspace.Catalog{})
+	assert.ErrorContains(t, err, "3 errors occurred")
+	for _, task := range rsm.RunSummary.Tasks {
+		assert.ErrorContains(t, err, fmt.Sprintf("Error sending %s summary to space: bad request", task.TaskID))
+	}
+}
+
+func TestClose_strictSpaces(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict %v", strict), func(t *testing.T) {
+			api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`), failures: 1, err: &client.StatusError{StatusCode: http.StatusForbidden, Body: "forbidden"}}
+			rsm := newTestMeta(api, 3)
+			rsm.strictSpaces = strict
+
+			err := rsm.Close(context.Background(), 0, workspace.Catalog{})
+			if !strict {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Assert(t, errors.Is(err, ErrSpacesUploadFailed))
+			assert.ErrorContains(t, err, "forbidden")
+		})
+	}
+}
+
+func TestClose_strictSpacesSuccess(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.strictSpaces = true
+
+	assert.NilError(t, rsm.Close(context.Background(), 0, workspace.Catalog{}))
+}
+
+func TestCloseWithError_success(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 3)
+
+	assert.NilError(t, rsm.CloseWithError(context.Background(), 0, workspace.Catalog{}))
+	assert.Equal(t, len(api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks")), 3)
+}
+
+// Error responses can have a JSON body too. It mustn't be mistaken for a created run.
+func TestRecord_createErrorBodyIsIgnored(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { _ = req.Body.Close() }()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"id":"run-id","url":"https://vercel.com/run","error":"invalid payload"}`))
+	}))
+	defer ts.Close()
+
+	apiClient := client.NewClient(turbostate.APIClientConfig{APIURL: ts.URL, Token: "my-token", TeamSlug: "my-team-slug"}, hclog.NewNullLogger(), "test")
+	rsm := newTestMeta(apiClient, 3)
+
+	url, errs := rsm.record(context.Background())
+	assert.Equal(t, url, "")
+	assert.Equal(t, len(errs), 1)
+	httpErr := &HTTPError{}
+	assert.Assert(t, errors.As(errs[0], &httpErr))
+	assert.Equal(t, httpErr.StatusCode, http.StatusBadRequest)
+	assert.DeepEqual(t, requests, []string{"POST /v0/spaces/space-id/runs"})
+}
+
+func TestNewSpacesClient_taskUpsert(t *testing.T) {
+	assert.Assert(t, !newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{}).taskUpsert)
+	assert.Assert(t, newSpacesClient(&fakeSpacesAPI{}, env.EnvironmentVariableMap{spacesTaskUpsertEnvVar: "true"}).taskUpsert)
+}
+
+func TestPostTaskSummaries_upsert(t *testing.T) {
+	api := &fakeSpacesAPI{}
+	rsm := newTestMeta(api, 0)
+	rsm.RunSummary.Tasks = []*TaskSummary{newTestTaskSummary("@scope/my-app#build")}
+	rsm.spacesClient.taskUpsert = true
+
+	errs := rsm.postTaskSummaries(context.Background(), "space-id", "run-id")
+	assert.Equal(t, len(errs), 0)
+
+	requests := api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks/@scope%2Fmy-app%23build")
+	assert.Equal(t, len(requests), 1)
+	assert.Equal(t, requests[0].method, http.MethodPut)
+	assert.Equal(t, api.requestCount(), 1)
+}
+
+func TestNewSpacesTaskPayload_workspacePath(t *testing.T) {
+	testCases := []struct {
+		name string
+		dir  string
+		want string
+	}{
+		{name: "nested workspace", dir: filepath.Join("apps", "web"), want: "apps/web"},
+		{name: "root workspace", dir: "", want: "."},
+	}
+
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			task := newTestTaskSummary("web#build")
+			task.Dir = tc.dir
+			assert.Equal(t, rsm.newSpacesTaskPayload(task).WorkspacePath, tc.want)
+		})
+	}
+}
+
+func TestNewSpacesRunCreatePayload_gitCommit(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.RunSummary.SCM = &scmState{Type: "git", Sha: "abc123", Branch: "main", commitAuthor: "Turbobot", commitMessage: "Add a feature"}
+
+	payload := rsm.newSpacesRunCreatePayload()
+	assert.Equal(t, payload.GitCommitAuthor, "Turbobot")
+	assert.Equal(t, payload.GitCommitMessage, "Add a feature")
+
+	// without commit info, e.g. outside of a git repo, the fields are left out
+	rsm.RunSummary.SCM = &scmState{Type: "git"}
+	body, err := json.Marshal(rsm.newSpacesRunCreatePayload())
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(body), "gitCommitAuthor"))
+	assert.Assert(t, !strings.Contains(string(body), "gitCommitMessage"))
+}
+
+func TestNewSpacesRunCreatePayload_gitRef(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.RunSummary.SCM = &scmState{Type: "git", Sha: "abc123", refType: refTypeTag, tag: "v1.0.0"}
+
+	payload := rsm.newSpacesRunCreatePayload()
+	assert.Equal(t, payload.GitRefType, "tag")
+	assert.Equal(t, payload.GitTag, "v1.0.0")
+	assert.Equal(t, payload.GitBranch, "")
+}
+
+// Dry runs only print the plan, so nothing is sent to the Space
+func TestClose_dryRunIsNotSent(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id"}`)}
+	rsm := newTestMeta(api, 0)
+	rsm.RunSummary.GlobalHashSummary = &GlobalHashSummary{}
+	rsm.runType = runTypeDryJSON
+
+	assert.NilError(t, rsm.Close(context.Background(), 0, workspace.Catalog{}))
+	assert.Equal(t, api.requestCount(), 0)
+}
+
+func TestNewRunSummary_spacesSettingsOnlyReadWithSpace(t *testing.T) {
+	t.Setenv(spacesProxyEnvVar, "not a url")
+	t.Setenv(spacesMaxTasksEnvVar, "lots")
+	t.Setenv(spacesLabelsEnvVar, "not a label!")
+	apiClient := client.NewClient(turbostate.APIClientConfig{}, hclog.NewNullLogger(), "test")
+	repoRoot := turbopath.AbsoluteSystemPath(t.TempDir())
+
+	// Without a Space, stray settings aren't read at all
+	ui := cli.NewMockUi()
+	_ = NewRunSummary(time.Now(), ui, repoRoot, "", "test", apiClient, util.RunOpts{}, nil, util.Infer, &GlobalHashSummary{}, "turbo run build")
+	assert.Equal(t, ui.ErrorWriter.String(), "")
+
+	ui = cli.NewMockUi()
+	_ = NewRunSummary(time.Now(), ui, repoRoot, "", "test", apiClient, util.RunOpts{ExperimentalSpaceID: "space-id"}, nil, util.Infer, &GlobalHashSummary{}, "turbo run build")
+	assert.Assert(t, strings.Contains(ui.ErrorWriter.String(), "Ignoring Spaces proxy"), ui.ErrorWriter.String())
+	assert.Assert(t, strings.Contains(ui.ErrorWriter.String(), "Sending every task to Spaces"), ui.ErrorWriter.String())
+	assert.Assert(t, strings.Contains(ui.ErrorWriter.String(), "Ignoring Spaces label"), ui.ErrorWriter.String())
+}
@@ -0,0 +1,47 @@
+package runsummary
+
+import (
+	"context"
+)
+
+// SpacesTracer starts spans for recording a run to Spaces, so that the upload shows up
+// alongside the caller's own traces. It's shaped so that an OpenTelemetry trace.Tracer
+// can be adapted to it without turbo depending on OpenTelemetry.
+type SpacesTracer interface {
+	// Start starts a span named name, as a child of any span in ctx, and returns a context
+	// that contains it
+	Start(ctx context.Context, name string) (context.Context, SpacesSpan)
+}
+
+// SpacesSpan is a span started by a SpacesTracer
+type SpacesSpan interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+const (
+	// spacesRecordSpan covers recording the run to one Space, from creating the run to marking it done
+	spacesRecordSpan = "spaces.record"
+	// spacesRequestSpan covers one request to Spaces, including its retries
+	spacesRequestSpan = "spaces.request"
+)
+
+// noopSpacesTracer is the tracer used unless one is set with SetSpacesTracer
+type noopSpacesTracer struct{}
+
+func (noopSpacesTracer) Start(ctx context.Context, name string) (context.Context, SpacesSpan) {
+	return ctx, noopSpacesSpan{}
+}
+
+type noopSpacesSpan struct{}
+
+func (noopSpacesSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpacesSpan) RecordError(err error)                      {}
+func (noopSpacesSpan) End()                                       {}
+
+// SetSpacesTracer sets the tracer that spans are started with while the run is recorded to Spaces.
+// There's a span for recording the run to each Space, with a child span for each request.
+func (rsm *Meta) SetSpacesTracer(tracer SpacesTracer) {
+	rsm.spacesClient.tracer = tracer
+}
@@ -0,0 +1,128 @@
+package runsummary
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// recordingSpacesTracer keeps every span it starts in memory, so that tests can check them once they've ended
+type recordingSpacesTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpacesSpan
+}
+
+type recordedSpacesSpan struct {
+	mu         sync.Mutex
+	name       string
+	parent     *recordedSpacesSpan
+	attributes map[string]interface{}
+	errs       []error
+	ended      bool
+}
+
+type recordedSpacesSpanKey struct{}
+
+func (t *recordingSpacesTracer) Start(ctx context.Context, name string) (context.Context, SpacesSpan) {
+	parent, _ := ctx.Value(recordedSpacesSpanKey{}).(*recordedSpacesSpan)
+	span := &recordedSpacesSpan{name: name, parent: parent, attributes: map[string]interface{}{}}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, recordedSpacesSpanKey{}, span), span
+}
+
+func (s *recordedSpacesSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *recordedSpacesSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordedSpacesSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+// named returns the spans called name, in the order they were started
+func (t *recordingSpacesTracer) named(name string) []*recordedSpacesSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := []*recordedSpacesSpan{}
+	for _, span := range t.spans {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestRecord_tracing(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 3)
+	rsm.spacesClient.taskBatchSize = 2
+	tracer := &recordingSpacesTracer{}
+	rsm.SetSpacesTracer(tracer)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+
+	records := tracer.named(spacesRecordSpan)
+	assert.Equal(t, len(records), 1)
+	record := records[0]
+	assert.Assert(t, record.ended)
+	assert.Equal(t, len(record.errs), 0)
+	assert.Equal(t, record.attributes["spaces.space_id"], "space-id")
+	assert.Equal(t, record.attributes["spaces.run_id"], "run-id")
+	assert.Equal(t, record.attributes["spaces.run_status"], spacesRunStatusCompleted)
+	assert.Equal(t, record.attributes["spaces.trace_id"], rsm.spacesClient.traceID)
+
+	// one request to create the run, two batches of tasks, and one to mark it done
+	requests := tracer.named(spacesRequestSpan)
+	assert.Equal(t, len(requests), 4)
+	urls := map[string]int{}
+	for _, request := range requests {
+		assert.Assert(t, request.ended)
+		assert.Equal(t, request.parent, record)
+		urls[request.attributes["http.method"].(string)+" "+request.attributes["http.url"].(string)]++
+	}
+	assert.DeepEqual(t, urls, map[string]int{
+		"POST /v0/spaces/space-id/runs":                    1,
+		"POST /v0/spaces/space-id/runs/run-id/tasks/batch": 2,
+		"PATCH /v0/spaces/space-id/runs/run-id":            1,
+	})
+}
+
+func TestRecord_tracingFailedRequest(t *testing.T) {
+	server := newFakeSpacesServer(t)
+	server.failEndpoint(http.MethodPost, "/v0/spaces/space-id/runs/run-id/tasks", http.StatusUnprocessableEntity)
+	rsm := server.newMeta(1)
+	tracer := &recordingSpacesTracer{}
+	rsm.SetSpacesTracer(tracer)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+
+	failed := []*recordedSpacesSpan{}
+	for _, request := range tracer.named(spacesRequestSpan) {
+		if len(request.errs) > 0 {
+			failed = append(failed, request)
+		}
+	}
+	assert.Equal(t, len(failed), 1)
+	assert.Equal(t, failed[0].attributes["http.url"], "/v0/spaces/space-id/runs/run-id/tasks")
+	assert.Equal(t, failed[0].attributes["http.status_code"], http.StatusUnprocessableEntity)
+
+	record := tracer.named(spacesRecordSpan)[0]
+	assert.Equal(t, len(record.errs), 1)
+	assert.Equal(t, record.attributes["spaces.run_status"], spacesRunStatusCompleted)
+}
@@ -0,0 +1,139 @@
+package runsummary
+
+import (
+	"encoding/json"
+)
+
+// The payloads sent to Spaces, as they're passed to a SpacesPayloadTransform
+type (
+	// SpacesRunPayload creates the run, or marks it as completed or cancelled
+	SpacesRunPayload = spacesRunPayload
+	// SpacesTaskPayload is the summary of one task, whether it's sent on its own or in a batch
+	SpacesTaskPayload = spacesTask
+	// SpacesGraphPayload is the run's task graph, which is only sent when it's turned on
+	SpacesGraphPayload = spacesGraph
+	// SpacesTaskStatsPayload is timings of the run's tasks grouped by task name, which is only sent when it's turned on
+	SpacesTaskStatsPayload = spacesTaskStats
+)
+
+// SpacesPayloadTransform changes payloads before they are sent to Spaces, e.g. to add labels
+// or remove fields. There's a method for each payload, which can change it in place.
+// TransformTask is called from several goroutines at once.
+type SpacesPayloadTransform interface {
+	TransformRun(payload *SpacesRunPayload)
+	TransformTask(payload *SpacesTaskPayload)
+	TransformDone(payload *SpacesRunPayload)
+	TransformGraph(payload *SpacesGraphPayload)
+	TransformTaskStats(payload *SpacesTaskStatsPayload)
+}
+
+// SpacesPayloadTransformFuncs is a SpacesPayloadTransform made of functions. Payloads without
+// a function are left as they are.
+type SpacesPayloadTransformFuncs struct {
+	Run       func(payload *SpacesRunPayload)
+	Task      func(payload *SpacesTaskPayload)
+	Done      func(payload *SpacesRunPayload)
+	Graph     func(payload *SpacesGraphPayload)
+	TaskStats func(payload *SpacesTaskStatsPayload)
+}
+
+// TransformRun calls f.Run, if it's set
+func (f SpacesPayloadTransformFuncs) TransformRun(payload *SpacesRunPayload) {
+	if f.Run != nil {
+		f.Run(payload)
+	}
+}
+
+// TransformTask calls f.Task, if it's set
+func (f SpacesPayloadTransformFuncs) TransformTask(payload *SpacesTaskPayload) {
+	if f.Task != nil {
+		f.Task(payload)
+	}
+}
+
+// TransformDone calls f.Done, if it's set
+func (f SpacesPayloadTransformFuncs) TransformDone(payload *SpacesRunPayload) {
+	if f.Done != nil {
+		f.Done(payload)
+	}
+}
+
+// TransformGraph calls f.Graph, if it's set
+func (f SpacesPayloadTransformFuncs) TransformGraph(payload *SpacesGraphPayload) {
+	if f.Graph != nil {
+		f.Graph(payload)
+	}
+}
+
+// TransformTaskStats calls f.TaskStats, if it's set
+func (f SpacesPayloadTransformFuncs) TransformTaskStats(payload *SpacesTaskStatsPayload) {
+	if f.TaskStats != nil {
+		f.TaskStats(payload)
+	}
+}
+
+// AddSpacesPayloadTransform registers a transform for the payloads that record the run to Spaces:
+// the run, task, done, graph and taskStats payloads. The full run summary, which is sent when
+// TURBO_SPACES_SEND_SUMMARY is set, is sent as it is. Transforms are applied in the order they
+// were added.
+func (rsm *Meta) AddSpacesPayloadTransform(transform SpacesPayloadTransform) {
+	rsm.payloadTransforms = append(rsm.payloadTransforms, transform)
+}
+
+// spacesPayloadKind says which transform applies to a payload, since the run and done payloads
+// have the same type
+type spacesPayloadKind int
+
+const (
+	spacesRunKind spacesPayloadKind = iota
+	spacesTaskKind
+	spacesDoneKind
+	spacesGraphKind
+	spacesTaskStatsKind
+)
+
+// spacesVersionedPayload is a payload that says which version of the schema it follows
+type spacesVersionedPayload interface {
+	setSchemaVersion(version string)
+}
+
+func (p *spacesRunPayload) setSchemaVersion(version string) {
+	p.SchemaVersion = version
+}
+
+func (t *spacesTask) setSchemaVersion(version string) {
+	t.SchemaVersion = version
+}
+
+func (g *spacesGraph) setSchemaVersion(version string) {
+	g.SchemaVersion = version
+}
+
+func (s *spacesTaskStats) setSchemaVersion(version string) {
+	s.SchemaVersion = version
+}
+
+// marshalSpacesPayload applies any registered transforms to payload, sets its schema version,
+// and marshals it. The transforms change payload in place.
+func (rsm *Meta) marshalSpacesPayload(kind spacesPayloadKind, payload spacesVersionedPayload) ([]byte, error) {
+	for _, transform := range rsm.payloadTransforms {
+		switch p := payload.(type) {
+		case *spacesRunPayload:
+			if kind == spacesDoneKind {
+				transform.TransformDone(p)
+			} else {
+				transform.TransformRun(p)
+			}
+		case *spacesTask:
+			transform.TransformTask(p)
+		case *spacesGraph:
+			transform.TransformGraph(p)
+		case *spacesTaskStats:
+			transform.TransformTaskStats(p)
+		}
+	}
+
+	// The version is set last, so that a transform can't send a payload that claims the wrong one
+	payload.setSchemaVersion(spacesSchemaVersion)
+	return json.Marshal(payload)
+}
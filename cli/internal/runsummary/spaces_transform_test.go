@@ -0,0 +1,146 @@
+package runsummary
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRecord_payloadTransform(t *testing.T) {
+	testCases := []struct {
+		name      string
+		batchSize int
+	}{
+		{name: "individual", batchSize: 0},
+		{name: "batched", batchSize: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+			rsm := newTestMeta(api, 3)
+			rsm.spacesClient.taskBatchSize = tc.batchSize
+
+			callsMu := sync.Mutex{}
+			calls := map[string]int{}
+			called := func(kind string) {
+				callsMu.Lock()
+				defer callsMu.Unlock()
+				calls[kind]++
+			}
+			rsm.AddSpacesPayloadTransform(SpacesPayloadTransformFuncs{
+				Run: func(payload *SpacesRunPayload) {
+					called("run")
+					payload.Labels = append(payload.Labels, "cc-1234")
+				},
+				Task: func(payload *SpacesTaskPayload) {
+					called("task")
+					payload.Tags = map[string]string{"costCenter": "cc-1234"}
+				},
+				Done: func(payload *SpacesRunPayload) {
+					called("done")
+					payload.Labels = append(payload.Labels, "cc-1234")
+				},
+			})
+
+			_, errs := rsm.record(context.Background())
+			assert.Equal(t, len(errs), 0)
+			assert.DeepEqual(t, calls, map[string]int{"run": 1, "task": 3, "done": 1})
+
+			for _, url := range []string{"/v0/spaces/space-id/runs", "/v0/spaces/space-id/runs/run-id"} {
+				requests := api.requestsTo(url)
+				assert.Equal(t, len(requests), 1)
+				payload := spacesRunPayload{}
+				assert.NilError(t, json.Unmarshal(requests[0].body, &payload))
+				assert.DeepEqual(t, payload.Labels, []string{"cc-1234"})
+			}
+
+			tasks := []spacesTask{}
+			if tc.batchSize > 0 {
+				for _, request := range api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks/batch") {
+					batch := []spacesTask{}
+					assert.NilError(t, json.Unmarshal(request.body, &batch))
+					tasks = append(tasks, batch...)
+				}
+			} else {
+				for _, request := range api.requestsTo("/v0/spaces/space-id/runs/run-id/tasks") {
+					task := spacesTask{}
+					assert.NilError(t, json.Unmarshal(request.body, &task))
+					tasks = append(tasks, task)
+				}
+			}
+			assert.Equal(t, len(tasks), 3)
+			for _, task := range tasks {
+				assert.DeepEqual(t, task.Tags, map[string]string{"costCenter": "cc-1234"})
+			}
+		})
+	}
+}
+
+func TestRecord_transformedRunIsValidated(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 2)
+	rsm.AddSpacesPayloadTransform(SpacesPayloadTransformFuncs{
+		Run: func(payload *SpacesRunPayload) {
+			payload.Command = ""
+		},
+	})
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 1)
+	assert.Assert(t, errors.Is(errs[0], ErrInvalidRunPayload))
+	assert.ErrorContains(t, errs[0], "invalid run: missing command")
+	// nothing is sent, since there's no run to add tasks to
+	assert.Equal(t, api.requestCount(), 0)
+}
+
+func TestMarshalSpacesPayload_schemaVersionIsKept(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	rsm.AddSpacesPayloadTransform(SpacesPayloadTransformFuncs{
+		Graph: func(payload *SpacesGraphPayload) {
+			payload.SchemaVersion = "0"
+		},
+	})
+
+	body, err := rsm.marshalSpacesPayload(spacesGraphKind, &spacesGraph{})
+	assert.NilError(t, err)
+	graph := spacesGraph{}
+	assert.NilError(t, json.Unmarshal(body, &graph))
+	assert.Equal(t, graph.SchemaVersion, spacesSchemaVersion)
+}
+
+func TestMarshalSpacesPayload_noTransforms(t *testing.T) {
+	rsm := newTestMeta(&fakeSpacesAPI{}, 0)
+	payload := &spacesRunPayload{Status: spacesRunStatusCompleted}
+
+	body, err := rsm.marshalSpacesPayload(spacesDoneKind, payload)
+	assert.NilError(t, err)
+	want, err := json.Marshal(payload)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), string(want))
+}
+
+func TestRecord_schemaVersion(t *testing.T) {
+	api := &fakeSpacesAPI{response: []byte(`{"id":"run-id","url":"https://vercel.com/run"}`)}
+	rsm := newTestMeta(api, 2)
+
+	_, errs := rsm.record(context.Background())
+	assert.Equal(t, len(errs), 0)
+	assert.Equal(t, len(api.requests), 4)
+	for _, request := range api.requests {
+		payload := map[string]interface{}{}
+		assert.NilError(t, json.Unmarshal(request.body, &payload))
+		assert.Equal(t, payload["schemaVersion"], spacesSchemaVersion, "%v %v", request.method, request.url)
+	}
+
+	heartbeat, err := json.Marshal(newSpacesHeartbeatPayload(time.Now()))
+	assert.NilError(t, err)
+	payload := map[string]interface{}{}
+	assert.NilError(t, json.Unmarshal(heartbeat, &payload))
+	assert.Equal(t, payload["schemaVersion"], spacesSchemaVersion)
+}
@@ -1,6 +1,7 @@
 package runsummary
 
 import (
+	"encoding/json"
 	"os"
 
 	"github.com/vercel/turbo/cli/internal/cache"
@@ -78,13 +79,41 @@ type TaskSummary struct {
 	Execution              *TaskExecutionSummary                 `json:"execution,omitempty"` // omit when it's not set
 }
 
+// UnmarshalJSON reads a TaskSummary back from a saved run summary. The resolved task definition
+// is written in the same format as a task in turbo.json, so it's read back the same way.
+func (ts *TaskSummary) UnmarshalJSON(data []byte) error {
+	// taskSummary has the same fields as TaskSummary, but not this method, so that it can be decoded as usual
+	type taskSummary TaskSummary
+	serializable := struct {
+		*taskSummary
+		ResolvedTaskDefinition *fs.BookkeepingTaskDefinition `json:"resolvedTaskDefinition"`
+	}{taskSummary: (*taskSummary)(ts)}
+	if err := json.Unmarshal(data, &serializable); err != nil {
+		return err
+	}
+
+	ts.ResolvedTaskDefinition = nil
+	if serializable.ResolvedTaskDefinition != nil {
+		taskDefinition := serializable.ResolvedTaskDefinition.GetTaskDefinition()
+		ts.ResolvedTaskDefinition = &taskDefinition
+	}
+	return nil
+}
+
 // GetLogs reads the Logfile and returns the data
 func (ts *TaskSummary) GetLogs() []byte {
+	logs, _ := ts.readLogs()
+	return logs
+}
+
+// readLogs reads the Logfile and returns the data, and whether the Logfile could be read.
+// This distinguishes a task with no output from a task whose logs weren't captured.
+func (ts *TaskSummary) readLogs() ([]byte, bool) {
 	bytes, err := os.ReadFile(ts.LogFile)
 	if err != nil {
-		return []byte{}
+		return []byte{}, false
 	}
-	return bytes
+	return bytes, true
 }
 
 // TaskEnvVarSummary contains the environment variables that impacted a task's hash
@@ -67,6 +67,34 @@ func GetCurrentBranch(dir turbopath.AbsoluteSystemPath) string {
 	return strings.TrimRight(string(out), "\n")
 }
 
+// GetCurrentCommit returns the author name and the subject line of the current commit
+func GetCurrentCommit(dir turbopath.AbsoluteSystemPath) (string, string) {
+	cmd := exec.Command("git", []string{"log", "-1", "--format=%an%n%s"}...)
+	cmd.Dir = dir.ToString()
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", ""
+	}
+	lines := strings.SplitN(strings.TrimRight(string(out), "\n"), "\n", 2)
+	if len(lines) != 2 {
+		return "", ""
+	}
+	return lines[0], lines[1]
+}
+
+// GetCurrentTag returns a tag that points at the current commit, if there is one
+func GetCurrentTag(dir turbopath.AbsoluteSystemPath) string {
+	cmd := exec.Command("git", []string{"describe", "--tags", "--exact-match", "HEAD"}...)
+	cmd.Dir = dir.ToString()
+
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(out), "\n")
+}
+
 // GetCurrentSha returns the current SHA
 func GetCurrentSha(dir turbopath.AbsoluteSystemPath) string {
 	cmd := exec.Command("git", []string{"rev-parse", "HEAD"}...)
@@ -81,6 +81,24 @@ func TestGetCurrentSHA(t *testing.T) {
 	gitCommand(t, testDir, []string{"config", "--global", "user.name", originalName})
 }
 
+func TestGetCurrentCommit(t *testing.T) {
+	testDir := getTestDir(t, "myrepo")
+	gitCommand(t, testDir, []string{"init"})
+
+	// there is no commit yet
+	author, message := GetCurrentCommit(testDir)
+	assert.Equal(t, author, "")
+	assert.Equal(t, message, "")
+
+	gitCommand(t, testDir, []string{"-c", "user.name=Turbobot", "-c", "user.email=turbo@vercel.com", "commit", "--allow-empty", "-m", "Add a feature", "-m", "With a longer description"})
+	author, message = GetCurrentCommit(testDir)
+	assert.Equal(t, author, "Turbobot")
+	assert.Equal(t, message, "Add a feature")
+
+	// cleanup
+	gitRm(t, testDir)
+}
+
 // Helper functions
 func getTestDir(t *testing.T, testName string) turbopath.AbsoluteSystemPath {
 	defaultCwd, err := os.Getwd()
@@ -134,3 +152,21 @@ func _gitCommand(cwd turbopath.AbsoluteSystemPath, args []string) (string, error
 
 	return string(out), nil
 }
+
+func TestGetCurrentTag(t *testing.T) {
+	testDir := getTestDir(t, "myrepo")
+	gitCommand(t, testDir, []string{"init"})
+	gitCommand(t, testDir, []string{"-c", "user.name=Turbobot", "-c", "user.email=turbo@vercel.com", "commit", "--allow-empty", "-m", "first commit"})
+
+	assert.Equal(t, GetCurrentTag(testDir), "")
+
+	gitCommand(t, testDir, []string{"tag", "v1.0.0"})
+	assert.Equal(t, GetCurrentTag(testDir), "v1.0.0")
+
+	// the tag no longer points at the current commit
+	gitCommand(t, testDir, []string{"-c", "user.name=Turbobot", "-c", "user.email=turbo@vercel.com", "commit", "--allow-empty", "-m", "second commit"})
+	assert.Equal(t, GetCurrentTag(testDir), "")
+
+	// cleanup
+	gitRm(t, testDir)
+}
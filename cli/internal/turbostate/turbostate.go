@@ -59,6 +59,7 @@ type RunPayload struct {
 	PkgInferenceRoot    string   `json:"pkg_inference_root"`
 	LogPrefix           string   `json:"log_prefix"`
 	ExperimentalSpaceID string   `json:"experimental_space_id"`
+	DrySpaces           bool     `json:"dry_spaces"`
 }
 
 // Command consists of the data necessary to run a command.
@@ -52,4 +52,6 @@ type RunOpts struct {
 	Summarize bool
 
 	ExperimentalSpaceID string
+	// If true, print the payloads for the Space instead of sending them
+	DrySpaces bool
 }
@@ -482,6 +482,9 @@ pub struct RunArgs {
     // Pass a string to enable posting Run Summaries to Vercel
     #[clap(long, hide = true)]
     pub experimental_space_id: Option<String>,
+    // Print the payloads that would be sent to the Space instead of sending them
+    #[clap(long, hide = true)]
+    pub dry_spaces: bool,
 }
 
 #[derive(clap::ValueEnum, Clone, Copy, Debug, PartialEq, Serialize)]